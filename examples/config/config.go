@@ -16,7 +16,7 @@ var psk = []byte{0xee, 0xd9, 0x50, 0xfd, 0xda, 0x4e, 0xc7, 0xea,
 func main() {
 	log.SetLevel(log.DebugLevel)
 
-	m, err := mesh.NewMesh("/dev/ttyUSB0", mesh.TRANSPORT_SERIAL)
+	m, err := mesh.NewMesh(mesh.DEVICE_AUTO, mesh.TRANSPORT_SERIAL)
 	if err != nil {
 		log.WithError(err).Fatal("could not connect to port")
 	}
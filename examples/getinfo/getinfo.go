@@ -12,7 +12,7 @@ import (
 func main() {
 	// log.SetLevel(log.DebugLevel)
 
-	m, err := mesh.NewMesh("/dev/ttyUSB0", mesh.TRANSPORT_SERIAL)
+	m, err := mesh.NewMesh(mesh.DEVICE_AUTO, mesh.TRANSPORT_SERIAL)
 	if err != nil {
 		log.WithError(err).Fatal()
 	}
@@ -1,5 +1,154 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/capture"
+	"github.com/nerdoftech/Meshtastic-go/pkg/decode"
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	"github.com/nerdoftech/Meshtastic-go/pkg/power"
+	"github.com/nerdoftech/Meshtastic-go/pkg/provision"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  decode    print FromRadio/ToRadio messages from hex, base64, raw serial bytes or a capture\n")
+	fmt.Fprintf(os.Stderr, "  provision configure attached radios from a manifest and write a report per radio\n")
+	fmt.Fprintf(os.Stderr, "  power     estimate the duty cycle and battery life of the sleep profiles\n")
+	os.Exit(2)
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "decode":
+		decodeCmd(os.Args[2:])
+	case "provision":
+		provisionCmd(os.Args[2:])
+	case "power":
+		powerCmd(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func decodeCmd(args []string) {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	format := fs.String("format", string(decode.FORMAT_HEX), fmt.Sprintf("input format, one of %v", decode.FORMATS))
+	dir := fs.String("dir", "", "rx for FromRadio, tx for ToRadio, empty to guess. Ignored for captures")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s decode [flags] [file]\n\nReads stdin when no file is given.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	d := decode.NewDecoder(os.Stdout, capture.Direction(*dir))
+	err := d.Decode(in, decode.Format(*format))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func provisionCmd(args []string) {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	manifest := fs.String("manifest", "", "JSON manifest of the radios to configure")
+	reportDir := fs.String("report", "reports", "directory for the per radio reports")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s provision -manifest file [flags] [device...]\n\nConfigures every radio found when no devices are given.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *manifest == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	man, err := provision.LoadManifest(*manifest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	paths := fs.Args()
+	if len(paths) == 0 {
+		devs, err := mesh.Discover()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, d := range devs {
+			paths = append(paths, d.Path)
+		}
+	}
+
+	reports := provision.Provision(man, provision.SerialTargets(paths))
+	err = provision.WriteReports(*reportDir, reports)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	failed := 0
+	for _, r := range reports {
+		fmt.Printf("%-16s !%08x %-14s %s\n", r.Path, r.NodeNum, r.Status, r.Error)
+		if r.Status != provision.STATUS_OK && r.Status != provision.STATUS_UNMATCHED {
+			failed++
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func powerCmd(args []string) {
+	fs := flag.NewFlagSet("power", flag.ExitOnError)
+	position := fs.Uint("position", power.DEFAULT_POSITION_BROADCAST_SECS, "position_broadcast_secs")
+	battery := fs.Float64("battery", 3000, "battery capacity in mAh")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s power [flags] [profile...]\n\nShows every profile when none are given.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
 
+	profiles := power.PROFILES
+	if fs.NArg() > 0 {
+		profiles = nil
+		for _, name := range fs.Args() {
+			p, err := power.Lookup(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			profiles = append(profiles, p)
+		}
+	}
+	for _, p := range profiles {
+		prefs := p.Apply(&message.RadioConfig_UserPreferences{PositionBroadcastSecs: uint32(*position)})
+		est := power.EstimateLife(prefs, power.DEFAULT_MODEL, *battery)
+		life := fmt.Sprintf("%6.1f days", est.Life.Hours()/24)
+		if est.Unbounded {
+			life = " unbounded "
+		}
+		fmt.Printf("%-14s duty %5.1f%% %7.2fmA position every %5ds life %s  %s\n", p.Name,
+			est.DutyCycle*100, est.AverageMA, est.PositionSecs, life, p.Description)
+		for _, err := range power.Check(prefs) {
+			fmt.Printf("%-14s warning: %s\n", "", err)
+		}
+	}
 }
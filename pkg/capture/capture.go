@@ -0,0 +1,68 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction of a frame relative to the host
+type Direction string
+
+const (
+	DIR_RX Direction = "rx" // FromRadio
+	DIR_TX Direction = "tx" // ToRadio
+
+	// Longest line accepted by ReadFrames, a PACKET_MTU frame in base64 plus the JSON around it
+	MAX_LINE = 4096
+)
+
+// Frame is one protobuf message as passed to or from the transport, without serial framing
+type Frame struct {
+	Time time.Time `json:"time"`
+	Dir  Direction `json:"dir"`
+	Data []byte    `json:"data"`
+}
+
+// Writer writes frames to a capture file, one JSON object per line.
+// It is safe to use from the transport's Listen goroutine and senders at the same time.
+type Writer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	now func() time.Time
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		enc: json.NewEncoder(w),
+		now: time.Now,
+	}
+}
+
+// Write timestamps and appends a frame
+func (w *Writer) Write(dir Direction, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(Frame{Time: w.now(), Dir: dir, Data: data})
+}
+
+// ReadFrames reads a whole capture file
+func ReadFrames(r io.Reader) ([]Frame, error) {
+	frames := make([]Frame, 0)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, MAX_LINE), MAX_LINE)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var f Frame
+		err := json.Unmarshal(sc.Bytes(), &f)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, f)
+	}
+	return frames, sc.Err()
+}
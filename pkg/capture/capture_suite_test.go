@@ -0,0 +1,255 @@
+package capture
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCapture(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Capture Suite")
+}
+
+var logger = func() *log.Logger {
+	l := log.New()
+	l.SetLevel(log.DebugLevel)
+	return l
+}()
+
+func marshal(pb proto.Message) []byte {
+	data, err := proto.Marshal(pb)
+	if err != nil {
+		logger.WithError(err).Fatal("error creating pb")
+	}
+	return data
+}
+
+// session is a short capture of a radio answering WantConfigId
+func session(t0 time.Time) []Frame {
+	return []Frame{
+		{Time: t0, Dir: DIR_TX, Data: marshal(&message.ToRadio{
+			Variant: &message.ToRadio_WantConfigId{WantConfigId: 77},
+		})},
+		{Time: t0.Add(10 * time.Millisecond), Dir: DIR_RX, Data: marshal(&message.FromRadio{
+			Variant: &message.FromRadio_MyInfo{MyInfo: &message.MyNodeInfo{MyNodeNum: 1234, FirmwareVersion: "0.9.1"}},
+		})},
+		{Time: t0.Add(20 * time.Millisecond), Dir: DIR_RX, Data: marshal(&message.FromRadio{
+			Variant: &message.FromRadio_NodeInfo{NodeInfo: &message.NodeInfo{Num: 5678}},
+		})},
+		{Time: t0.Add(30 * time.Millisecond), Dir: DIR_RX, Data: marshal(&message.FromRadio{
+			Variant: &message.FromRadio_ConfigCompleteId{ConfigCompleteId: 77},
+		})},
+	}
+}
+
+var _ = Describe("capture", func() {
+	t0 := time.Unix(1594000000, 0).UTC()
+	Context("file format", func() {
+		It("should read back what was written", func() {
+			buf := &bytes.Buffer{}
+			w := NewWriter(buf)
+			w.now = func() time.Time { return t0 }
+			Expect(w.Write(DIR_TX, []byte{1, 2})).Should(Succeed())
+			Expect(w.Write(DIR_RX, []byte{3})).Should(Succeed())
+			Expect(buf.String()).Should(HavePrefix(`{"time":"2020-07-06T01:46:40Z","dir":"tx","data":"AQI="}` + "\n"))
+
+			frames, err := ReadFrames(buf)
+			Expect(err).Should(BeNil())
+			Expect(frames).Should(Equal([]Frame{
+				{Time: t0, Dir: DIR_TX, Data: []byte{1, 2}},
+				{Time: t0, Dir: DIR_RX, Data: []byte{3}},
+			}))
+		})
+		It("should error on garbage", func() {
+			_, err := ReadFrames(bytes.NewBufferString("not json\n"))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Context("Recorder", func() {
+		It("should record both directions", func() {
+			ctrl := gomock.NewController(GinkgoT())
+			inner := mt.NewMockTransportInterface(ctrl)
+			var innerCh chan []byte
+			buf := &bytes.Buffer{}
+			tf := NewRecorder(buf, func(rxCh chan []byte, mu *sync.Mutex) mt.TransportInterface {
+				innerCh = rxCh
+				return inner
+			}, WithLogger(logger))
+			rxCh := make(chan []byte, 1)
+			tr := tf(rxCh, &sync.Mutex{})
+
+			listening := make(chan bool)
+			inner.EXPECT().Connect().Return(nil)
+			inner.EXPECT().SendToRadio([]byte{1}).Return(nil)
+			inner.EXPECT().Listen().Do(func() { <-listening })
+			inner.EXPECT().Close().Do(func() { close(listening) })
+
+			Expect(tr.Connect()).Should(Succeed())
+			go tr.Listen()
+			Expect(tr.SendToRadio([]byte{1})).Should(Succeed())
+			innerCh <- []byte{2}
+			Eventually(rxCh).Should(Receive(Equal([]byte{2})))
+			tr.Close()
+
+			frames, err := ReadFrames(buf)
+			Expect(err).Should(BeNil())
+			Expect(frames).Should(HaveLen(2))
+			Expect(frames[0].Dir).Should(Equal(DIR_TX))
+			Expect(frames[1].Dir).Should(Equal(DIR_RX))
+			Expect(frames[1].Data).Should(Equal([]byte{2}))
+		})
+		It("should stop forwarding when closed while nobody reads", func() {
+			ctrl := gomock.NewController(GinkgoT())
+			inner := mt.NewMockTransportInterface(ctrl)
+			var innerCh chan []byte
+			tr := NewRecorder(&bytes.Buffer{}, func(rxCh chan []byte, mu *sync.Mutex) mt.TransportInterface {
+				innerCh = rxCh
+				return inner
+			}, WithLogger(logger))(make(chan []byte), &sync.Mutex{}).(*Recorder)
+
+			inner.EXPECT().Close()
+			stopped := make(chan bool)
+			go func() {
+				tr.forward()
+				close(stopped)
+			}()
+			innerCh <- []byte{2}
+			tr.Close()
+			Eventually(stopped).Should(BeClosed())
+		})
+	})
+	Context("pcapng", func() {
+		// blocks splits a pcapng file into block type and body
+		blocks := func(b []byte) ([]uint32, [][]byte) {
+			types := make([]uint32, 0)
+			bodies := make([][]byte, 0)
+			for len(b) > 0 {
+				l := pcapOrder.Uint32(b[4:])
+				Expect(pcapOrder.Uint32(b[l-4:])).Should(Equal(l))
+				types = append(types, pcapOrder.Uint32(b))
+				bodies = append(bodies, b[8:l-4])
+				b = b[l:]
+			}
+			return types, bodies
+		}
+		It("should write frames and packets", func() {
+			frames := session(t0)
+			pkt := &message.MeshPacket{From: 0x1234, To: 0xffffffff, Id: 9, HopLimit: 3, RxSnr: 6.25}
+			frames = append(frames, Frame{Time: t0.Add(time.Second), Dir: DIR_RX, Data: marshal(&message.FromRadio{
+				Variant: &message.FromRadio_Packet{Packet: pkt},
+			})})
+			buf := &bytes.Buffer{}
+			Expect(WritePcap(buf, frames)).Should(Succeed())
+			p := &PcapWriter{w: buf}
+			Expect(p.WritePacket(t0, pkt)).Should(Succeed())
+
+			types, bodies := blocks(buf.Bytes())
+			Expect(types).Should(Equal([]uint32{BLOCK_SHB, BLOCK_IDB, BLOCK_EPB, BLOCK_EPB, BLOCK_EPB, BLOCK_EPB, BLOCK_EPB, BLOCK_EPB}))
+			Expect(pcapOrder.Uint32(bodies[0])).Should(Equal(uint32(BYTE_ORDER_MAGIC)))
+			Expect(pcapOrder.Uint16(bodies[1])).Should(Equal(uint16(LINKTYPE_USER0)))
+
+			// WantConfigId, outbound
+			epb := bodies[2]
+			ts := uint64(pcapOrder.Uint32(epb[4:]))<<32 | uint64(pcapOrder.Uint32(epb[8:]))
+			Expect(ts).Should(Equal(uint64(t0.UnixNano())))
+			Expect(epb[20]).Should(Equal(PCAP_TO_RADIO))
+			Expect(epb[21 : 20+pcapOrder.Uint32(epb[12:])]).Should(Equal(frames[0].Data))
+
+			comment := "from=!00001234 to=!ffffffff id=9 hop_limit=3 rx_snr=6.25"
+			Expect(string(bodies[6])).Should(ContainSubstring(comment))
+			Expect(bodies[7][20]).Should(Equal(PCAP_MESH_PACKET))
+			Expect(string(bodies[7])).Should(ContainSubstring(comment))
+			Expect(string(bodies[3])).ShouldNot(ContainSubstring("from="))
+		})
+	})
+	Context("Replay", func() {
+		It("should drive a mesh", func() {
+			tf := NewReplay(session(t0), 0, WithLogger(logger))
+			var replay *Replay
+			m := mesh.NewMeshWithTransport(func(rxCh chan []byte, mu *sync.Mutex) mt.TransportInterface {
+				tr := tf(rxCh, mu)
+				replay = tr.(*Replay)
+				return tr
+			}, mesh.WithLogger(logger))
+			nodes := make(chan uint32, 1)
+			m.Subscribe(mesh.TOPIC_NODE, func(n interface{}) {
+				nodes <- n.(*message.NodeInfo).Num
+			})
+
+			Expect(m.Connect()).Should(Succeed())
+			defer m.Close()
+			Expect(m.WaitForConfig(time.Second)).Should(Succeed())
+			Expect(m.GetMyNodeInfo().GetMyNodeNum()).Should(Equal(uint32(1234)))
+			Eventually(nodes).Should(Receive(Equal(uint32(5678))))
+			Eventually(replay.Done()).Should(BeClosed())
+			Expect(replay.Sent()).Should(HaveLen(1))
+		})
+		It("should keep the original timing scaled by speed", func() {
+			frames := session(t0)
+			frames[3].Time = t0.Add(time.Second)
+			tr := NewReplay(frames, 20, WithLogger(logger))(make(chan []byte, 10), &sync.Mutex{}).(*Replay)
+			tr.SendToRadio([]byte{})
+			start := time.Now()
+			go tr.Listen()
+			Eventually(tr.Done()).Should(BeClosed())
+			Expect(time.Since(start)).Should(BeNumerically(">=", 49*time.Millisecond))
+		})
+		It("should stop when closed", func() {
+			frames := session(t0)
+			frames[3].Time = t0.Add(time.Hour)
+			tr := NewReplay(frames, 1000, WithLogger(logger))(make(chan []byte, 10), &sync.Mutex{}).(*Replay)
+			tr.SendToRadio([]byte{})
+			go tr.Listen()
+			tr.Close()
+			Eventually(tr.Done()).Should(BeClosed())
+		})
+		It("should stop when closed while nobody reads", func() {
+			tr := NewReplay(session(t0), 0, WithLogger(logger))(make(chan []byte), &sync.Mutex{}).(*Replay)
+			tr.SendToRadio([]byte{})
+			go tr.Listen()
+			time.Sleep(10 * time.Millisecond)
+			tr.Close()
+			Eventually(tr.Done()).Should(BeClosed())
+		})
+	})
+	Context("fixtures", func() {
+		It("should replay testdata/session.jsonl", func() {
+			f, err := os.Open("testdata/session.jsonl")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer f.Close()
+			frames, err := ReadFrames(f)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			m := mesh.NewMeshWithTransport(NewReplay(frames, 0, WithLogger(logger)), mesh.WithLogger(logger))
+			texts := make(chan string, 2)
+			m.Subscribe(mesh.TOPIC_DATA, func(p interface{}) {
+				texts <- string(p.(*message.MeshPacket).GetDecoded().GetData().GetPayload())
+			})
+			Expect(m.Connect()).Should(Succeed())
+			defer m.Close()
+
+			Expect(m.GetMyNodeInfo().GetMyNodeNum()).Should(Equal(uint32(0x2a4b5c6d)))
+			Expect(m.GetMyNodeInfo().GetFirmwareVersion()).Should(Equal("0.9.1"))
+			Expect(m.GetRadioConfig().GetChannelSettings().GetName()).Should(Equal("Default"))
+			Expect(m.GetOwner().GetLongName()).Should(Equal("Base"))
+			Expect(m.GetNodes()).Should(HaveLen(2))
+			Eventually(texts).Should(Receive(Equal("on my way")))
+			// The repeated copy is dropped
+			Consistently(texts, 50*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+})
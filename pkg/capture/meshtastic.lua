@@ -0,0 +1,47 @@
+-- Wireshark dissector for pcapng files written by capture.PcapWriter.
+--
+-- Copy to your Wireshark personal plugins folder. To decode the protobuf
+-- messages, add the directory holding mesh.proto (the proto submodule) under
+-- Preferences > Protocols > ProtoBuf > Protobuf search paths.
+--
+-- Packets use link type USER0 (147). The first byte says which message
+-- follows: 0 FromRadio, 1 ToRadio, 2 MeshPacket. The packet comment holds
+-- the MeshPacket from, to, id, hop_limit and rx_snr.
+
+local meshtastic = Proto("meshtastic", "Meshtastic")
+
+local kinds = {
+    [0] = "FromRadio",
+    [1] = "ToRadio",
+    [2] = "MeshPacket",
+}
+
+local f_kind = ProtoField.uint8("meshtastic.kind", "Message", base.DEC, kinds)
+meshtastic.fields = { f_kind }
+
+local protobuf = Dissector.get("protobuf")
+local data = Dissector.get("data")
+
+function meshtastic.dissector(tvb, pinfo, tree)
+    if tvb:len() < 1 then
+        return 0
+    end
+    local kind = kinds[tvb(0, 1):uint()] or "unknown"
+    pinfo.cols.protocol = "Meshtastic"
+    pinfo.cols.info = kind
+
+    local subtree = tree:add(meshtastic, tvb(), "Meshtastic " .. kind)
+    subtree:add(f_kind, tvb(0, 1))
+
+    local payload = tvb(1):tvb()
+    if protobuf ~= nil and kinds[tvb(0, 1):uint()] ~= nil then
+        -- mesh.proto has no package, the message names are top level
+        pinfo.private["pb_msg_type"] = "message," .. kind
+        protobuf:call(payload, pinfo, subtree)
+    else
+        data:call(payload, pinfo, subtree)
+    end
+    return tvb:len()
+end
+
+DissectorTable.get("wtap_encap"):add(wtap.USER0, meshtastic)
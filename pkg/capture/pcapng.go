@@ -0,0 +1,173 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+)
+
+// pcapng block types and options, see https://datatracker.ietf.org/doc/draft-tuexen-opsawg-pcapng/
+const (
+	BLOCK_SHB = 0x0a0d0d0a
+	BLOCK_IDB = 0x00000001
+	BLOCK_EPB = 0x00000006
+
+	BYTE_ORDER_MAGIC = 0x1a2b3c4d
+
+	OPT_END     = 0
+	OPT_COMMENT = 1
+	OPT_IF_NAME = 2
+	OPT_FLAGS   = 2 // epb_flags, bits 0-1 are the direction
+	OPT_TSRESOL = 9
+
+	EPB_INBOUND  = 1
+	EPB_OUTBOUND = 2
+
+	// Private use link type, meshtastic.lua registers for it
+	LINKTYPE_USER0 = 147
+	PCAP_SNAPLEN   = 0xffff
+)
+
+// The first byte of every pcapng packet says what protobuf message follows
+const (
+	PCAP_FROM_RADIO  byte = 0
+	PCAP_TO_RADIO    byte = 1
+	PCAP_MESH_PACKET byte = 2
+)
+
+var pcapOrder = binary.LittleEndian
+
+// PcapWriter writes frames and MeshPackets as pcapng for Wireshark
+type PcapWriter struct {
+	w io.Writer
+}
+
+// NewPcapWriter writes the section and interface headers to w
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	p := &PcapWriter{w: w}
+
+	shb := &bytes.Buffer{}
+	binary.Write(shb, pcapOrder, uint32(BYTE_ORDER_MAGIC))
+	binary.Write(shb, pcapOrder, uint16(1)) // major
+	binary.Write(shb, pcapOrder, uint16(0)) // minor
+	binary.Write(shb, pcapOrder, int64(-1)) // section length not known
+	writeOpt(shb, OPT_END, nil)
+	err := p.writeBlock(BLOCK_SHB, shb.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	idb := &bytes.Buffer{}
+	binary.Write(idb, pcapOrder, uint16(LINKTYPE_USER0))
+	binary.Write(idb, pcapOrder, uint16(0))
+	binary.Write(idb, pcapOrder, uint32(PCAP_SNAPLEN))
+	writeOpt(idb, OPT_IF_NAME, []byte("meshtastic"))
+	writeOpt(idb, OPT_TSRESOL, []byte{9}) // nanoseconds
+	writeOpt(idb, OPT_END, nil)
+	err = p.writeBlock(BLOCK_IDB, idb.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WriteFrame writes a FromRadio or ToRadio frame from a capture
+func (p *PcapWriter) WriteFrame(f Frame) error {
+	if f.Dir == DIR_TX {
+		var msg message.ToRadio
+		comment := ""
+		if proto.Unmarshal(f.Data, &msg) == nil && msg.GetPacket() != nil {
+			comment = PacketComment(msg.GetPacket())
+		}
+		return p.writePacket(f.Time, PCAP_TO_RADIO, EPB_OUTBOUND, f.Data, comment)
+	}
+	var msg message.FromRadio
+	comment := ""
+	if proto.Unmarshal(f.Data, &msg) == nil && msg.GetPacket() != nil {
+		comment = PacketComment(msg.GetPacket())
+	}
+	return p.writePacket(f.Time, PCAP_FROM_RADIO, EPB_INBOUND, f.Data, comment)
+}
+
+// WritePacket writes a MeshPacket, e.g. from a TOPIC_DATA subscriber
+func (p *PcapWriter) WritePacket(t time.Time, pkt *message.MeshPacket) error {
+	data, err := proto.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	return p.writePacket(t, PCAP_MESH_PACKET, EPB_INBOUND, data, PacketComment(pkt))
+}
+
+// WritePcap converts a whole capture
+func WritePcap(w io.Writer, frames []Frame) error {
+	p, err := NewPcapWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, f := range frames {
+		err = p.WriteFrame(f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PacketComment holds the MeshPacket header fields, Wireshark shows it as the packet comment
+func PacketComment(pkt *message.MeshPacket) string {
+	return fmt.Sprintf("from=!%08x to=!%08x id=%d hop_limit=%d rx_snr=%.2f",
+		pkt.GetFrom(), pkt.GetTo(), pkt.GetId(), pkt.GetHopLimit(), pkt.GetRxSnr())
+}
+
+func (p *PcapWriter) writePacket(t time.Time, kind byte, flags uint32, data []byte, comment string) error {
+	pkt := append([]byte{kind}, data...)
+	ts := uint64(t.UnixNano())
+
+	epb := &bytes.Buffer{}
+	binary.Write(epb, pcapOrder, uint32(0)) // interface
+	binary.Write(epb, pcapOrder, uint32(ts>>32))
+	binary.Write(epb, pcapOrder, uint32(ts))
+	binary.Write(epb, pcapOrder, uint32(len(pkt))) // captured
+	binary.Write(epb, pcapOrder, uint32(len(pkt))) // original
+	epb.Write(pad(pkt))
+	if comment != "" {
+		writeOpt(epb, OPT_COMMENT, []byte(comment))
+	}
+	fl := make([]byte, 4)
+	pcapOrder.PutUint32(fl, flags)
+	writeOpt(epb, OPT_FLAGS, fl)
+	writeOpt(epb, OPT_END, nil)
+	return p.writeBlock(BLOCK_EPB, epb.Bytes())
+}
+
+// writeBlock adds the type and both total length fields around body
+func (p *PcapWriter) writeBlock(typ uint32, body []byte) error {
+	total := uint32(len(body) + 12)
+	buf := &bytes.Buffer{}
+	binary.Write(buf, pcapOrder, typ)
+	binary.Write(buf, pcapOrder, total)
+	buf.Write(body)
+	binary.Write(buf, pcapOrder, total)
+	_, err := p.w.Write(buf.Bytes())
+	return err
+}
+
+func writeOpt(buf *bytes.Buffer, code uint16, val []byte) {
+	binary.Write(buf, pcapOrder, code)
+	binary.Write(buf, pcapOrder, uint16(len(val)))
+	buf.Write(pad(val))
+}
+
+// pad to 32 bits
+func pad(b []byte) []byte {
+	if n := len(b) % 4; n != 0 {
+		return append(b, make([]byte, 4-n)...)
+	}
+	return b
+}
@@ -0,0 +1,123 @@
+package capture
+
+import (
+	"io"
+	"sync"
+
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Option configures a Recorder or Replay
+type Option func(*options)
+
+type options struct {
+	logger log.FieldLogger
+}
+
+// WithLogger sends logs to l instead of the logrus standard logger
+func WithLogger(l log.FieldLogger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+func newOptions(component string, opts []Option) *options {
+	o := &options{logger: log.StandardLogger()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.logger = o.logger.WithField(mt.FIELD_COMPONENT, component)
+	return o
+}
+
+// Recorder passes everything through to the wrapped transport and writes each frame to a capture
+type Recorder struct {
+	inner  mt.TransportInterface
+	w      *Writer
+	in     chan []byte // inner transport queues here
+	out    chan []byte // mesh rxChan
+	outMu  *sync.Mutex
+	done   chan struct{}
+	once   sync.Once
+	logger log.FieldLogger
+}
+
+// NewRecorder wraps the transport made by inner, writing its traffic to w
+func NewRecorder(w io.Writer, inner mt.TransportFactory, opts ...Option) mt.TransportFactory {
+	o := newOptions("recorder", opts)
+	cw := NewWriter(w)
+	return func(rxCh chan []byte, mu *sync.Mutex) mt.TransportInterface {
+		r := &Recorder{
+			w:      cw,
+			in:     make(chan []byte, cap(rxCh)),
+			out:    rxCh,
+			outMu:  mu,
+			done:   make(chan struct{}),
+			logger: o.logger,
+		}
+		r.inner = inner(r.in, &sync.Mutex{})
+		return r
+	}
+}
+
+// Wrap is NewRecorder for mesh.WithTransportWrapper
+func Wrap(w io.Writer, opts ...Option) func(mt.TransportFactory) mt.TransportFactory {
+	return func(tf mt.TransportFactory) mt.TransportFactory {
+		return NewRecorder(w, tf, opts...)
+	}
+}
+
+func (r *Recorder) Connect() error {
+	return r.inner.Connect()
+}
+
+func (r *Recorder) SendToRadio(data []byte) error {
+	r.record(DIR_TX, data)
+	return r.inner.SendToRadio(data)
+}
+
+// Listen runs the wrapped transport's Listen, should be run in goroutine
+func (r *Recorder) Listen() {
+	go r.forward()
+	r.inner.Listen()
+}
+
+func (r *Recorder) Close() {
+	r.inner.Close()
+	r.once.Do(func() { close(r.done) })
+}
+
+// forward records received frames and passes them on until Close
+func (r *Recorder) forward() {
+	for {
+		select {
+		case data := <-r.in:
+			r.record(DIR_RX, data)
+			if !r.push(data) {
+				return
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// push passes data on to the mesh, false once the recorder was closed
+func (r *Recorder) push(data []byte) bool {
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+	select {
+	case r.out <- data:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+func (r *Recorder) record(dir Direction, data []byte) {
+	err := r.w.Write(dir, data)
+	if err != nil {
+		r.logger.WithError(err).Error("could not write capture")
+	}
+}
@@ -0,0 +1,170 @@
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long Replay waits for the mesh to send what was sent at the same point in the capture
+const TX_WAIT = time.Second
+
+// Replay is a transport that plays back the received frames of a capture
+type Replay struct {
+	frames   []Frame
+	speed    float64
+	rxCh     chan []byte
+	mu       *sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	sentMu   sync.Mutex
+	sent     [][]byte
+	sentSig  chan struct{}
+	configID uint32 // last WantConfigId sent, replaces the one in the capture
+	logger   log.FieldLogger
+}
+
+// NewReplay plays frames at speed times the original rate, 0 sends them without waiting.
+// Frames sent to the radio are kept for Sent and otherwise ignored.
+func NewReplay(frames []Frame, speed float64, opts ...Option) mt.TransportFactory {
+	o := newOptions("replay", opts)
+	return func(rxCh chan []byte, mu *sync.Mutex) mt.TransportInterface {
+		return &Replay{
+			frames:  frames,
+			speed:   speed,
+			rxCh:    rxCh,
+			mu:      mu,
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+			sent:    make([][]byte, 0),
+			sentSig: make(chan struct{}, 1),
+			logger:  o.logger,
+		}
+	}
+}
+
+func (r *Replay) Connect() error {
+	return nil
+}
+
+func (r *Replay) SendToRadio(data []byte) error {
+	r.sentMu.Lock()
+	defer r.sentMu.Unlock()
+	r.sent = append(r.sent, data)
+	select {
+	case r.sentSig <- struct{}{}:
+	default:
+	}
+
+	var msg message.ToRadio
+	if proto.Unmarshal(data, &msg) == nil && msg.GetWantConfigId() != 0 {
+		atomic.StoreUint32(&r.configID, msg.GetWantConfigId())
+	}
+	return nil
+}
+
+// Sent returns the frames the mesh sent so far
+func (r *Replay) Sent() [][]byte {
+	r.sentMu.Lock()
+	defer r.sentMu.Unlock()
+	return append([][]byte{}, r.sent...)
+}
+
+// Done is closed when all frames were played or the replay was closed
+func (r *Replay) Done() <-chan struct{} {
+	return r.done
+}
+
+// Listen plays the capture, should be run in goroutine.
+// Received frames that followed a sent one in the capture wait for the mesh to send as well.
+func (r *Replay) Listen() {
+	defer close(r.done)
+	var last time.Time
+	tx := 0
+	for _, f := range r.frames {
+		if f.Dir == DIR_TX {
+			tx++
+			r.waitSent(tx)
+			continue
+		}
+		if r.speed > 0 && !last.IsZero() {
+			select {
+			case <-time.After(time.Duration(float64(f.Time.Sub(last)) / r.speed)):
+			case <-r.stop:
+				return
+			}
+		}
+		last = f.Time
+		r.logger.WithField(mt.FIELD_PACKET_LEN, len(f.Data)).Debug("replaying frame")
+		if !r.push(r.rewrite(f.Data)) {
+			return
+		}
+	}
+	r.logger.Debug("replay finished")
+}
+
+// push hands data to the mesh, false once the replay was closed
+func (r *Replay) push(data []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.stop:
+		return false
+	default:
+	}
+	select {
+	case r.rxCh <- data:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+func (r *Replay) waitSent(n int) {
+	timeout := time.After(TX_WAIT)
+	for {
+		r.sentMu.Lock()
+		count := len(r.sent)
+		r.sentMu.Unlock()
+		if count >= n {
+			return
+		}
+		select {
+		case <-r.sentSig:
+		case <-r.stop:
+			return
+		case <-timeout:
+			r.logger.Debug("mesh did not send, replaying anyway")
+			return
+		}
+	}
+}
+
+// rewrite answers the mesh's WantConfigId, the id in the capture is from another session
+func (r *Replay) rewrite(data []byte) []byte {
+	var msg message.FromRadio
+	if proto.Unmarshal(data, &msg) != nil || msg.GetConfigCompleteId() == 0 {
+		return data
+	}
+	id := atomic.LoadUint32(&r.configID)
+	if id == 0 {
+		return data
+	}
+	msg.Variant = &message.FromRadio_ConfigCompleteId{ConfigCompleteId: id}
+	out, err := proto.Marshal(&msg)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+func (r *Replay) Close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
@@ -0,0 +1,209 @@
+package decode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/capture"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	"github.com/nerdoftech/Meshtastic-go/pkg/serial"
+)
+
+// Format of the decoder input
+type Format string
+
+const (
+	FORMAT_HEX     Format = "hex"     // one message or framed chunk per line, whitespace and 0x ignored
+	FORMAT_BASE64  Format = "base64"  // one message or framed chunk per line
+	FORMAT_RAW     Format = "raw"     // bytes as read from the serial port
+	FORMAT_CAPTURE Format = "capture" // capture.Writer file
+)
+
+var FORMATS = []Format{FORMAT_HEX, FORMAT_BASE64, FORMAT_RAW, FORMAT_CAPTURE}
+
+var ErrUnknownFormat = errors.New("unknown input format")
+
+var frameHeader = []byte{serial.START1, serial.START2}
+
+// Decoder prints serial frames and FromRadio/ToRadio messages in a readable form
+type Decoder struct {
+	w    io.Writer
+	dir  capture.Direction // "" guesses from the message
+	buf  []byte            // bytes of an unfinished frame
+	line []byte            // console text between frames
+}
+
+// NewDecoder prints to w. dir is capture.DIR_RX for FromRadio, capture.DIR_TX for ToRadio
+// or "" to try both.
+func NewDecoder(w io.Writer, dir capture.Direction) *Decoder {
+	return &Decoder{w: w, dir: dir}
+}
+
+// Decode reads all of r and prints every message in it
+func (d *Decoder) Decode(r io.Reader, format Format) error {
+	switch format {
+	case FORMAT_CAPTURE:
+		frames, err := capture.ReadFrames(r)
+		if err != nil {
+			return err
+		}
+		for _, f := range frames {
+			fmt.Fprintf(d.w, "%s ", f.Time.Format("15:04:05.000"))
+			d.Message(f.Dir, f.Data)
+		}
+		return nil
+	case FORMAT_RAW:
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		d.Stream(data)
+	case FORMAT_HEX, FORMAT_BASE64:
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			data, err := parseLine(sc.Text(), format)
+			if err != nil {
+				return err
+			}
+			if len(data) == 0 {
+				continue
+			}
+			d.Chunk(data)
+		}
+		if sc.Err() != nil {
+			return sc.Err()
+		}
+	default:
+		return ErrUnknownFormat
+	}
+	d.Flush()
+	return nil
+}
+
+func parseLine(line string, format Format) ([]byte, error) {
+	line = strings.TrimSpace(line)
+	if format == FORMAT_BASE64 {
+		return base64.StdEncoding.DecodeString(line)
+	}
+	line = strings.ReplaceAll(line, "0x", "")
+	line = strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ','
+	}), "")
+	return hex.DecodeString(line)
+}
+
+// Chunk prints data as one message, unless it has a serial header or finishes an earlier frame
+func (d *Decoder) Chunk(data []byte) {
+	if len(d.buf) == 0 && !bytes.HasPrefix(data, frameHeader) {
+		d.Message(d.dir, data)
+		return
+	}
+	d.Stream(data)
+}
+
+// Stream splits serial port bytes into frames and firmware console lines
+func (d *Decoder) Stream(data []byte) {
+	d.buf = append(d.buf, data...)
+	for {
+		i := bytes.Index(d.buf, frameHeader)
+		if i < 0 {
+			// Keep a trailing START1, it may be the start of a header
+			keep := 0
+			if len(d.buf) > 0 && d.buf[len(d.buf)-1] == serial.START1 {
+				keep = 1
+			}
+			d.text(d.buf[:len(d.buf)-keep])
+			d.buf = d.buf[len(d.buf)-keep:]
+			return
+		}
+		d.text(d.buf[:i])
+		d.buf = d.buf[i:]
+		if len(d.buf) < 4 {
+			return
+		}
+		n := int(d.buf[2])<<8 | int(d.buf[3])
+		if n > serial.PACKET_MTU {
+			fmt.Fprintf(d.w, "frame of %d bytes exceeds MTU, discarding header\n", n)
+			d.buf = d.buf[2:]
+			continue
+		}
+		if len(d.buf) < 4+n {
+			return
+		}
+		d.Message(d.dir, d.buf[4:4+n])
+		d.buf = d.buf[4+n:]
+	}
+}
+
+// Flush prints what is left of an unfinished frame or console line
+func (d *Decoder) Flush() {
+	if len(d.buf) > 0 {
+		fmt.Fprintf(d.w, "incomplete frame: %s\n", hex.EncodeToString(d.buf))
+		d.buf = nil
+	}
+	if len(d.line) > 0 {
+		fmt.Fprintf(d.w, "console: %s\n", d.line)
+		d.line = nil
+	}
+}
+
+func (d *Decoder) text(b []byte) {
+	for _, c := range b {
+		switch c {
+		case '\n':
+			if len(d.line) > 0 {
+				fmt.Fprintf(d.w, "console: %s\n", d.line)
+			}
+			d.line = d.line[:0]
+		case '\r':
+		default:
+			d.line = append(d.line, c)
+		}
+	}
+}
+
+// Message prints one FromRadio (DIR_RX) or ToRadio (DIR_TX), "" tries both
+func (d *Decoder) Message(dir capture.Direction, data []byte) {
+	var msg proto.Message
+	switch dir {
+	case capture.DIR_RX:
+		msg = unmarshal(data, &message.FromRadio{})
+	case capture.DIR_TX:
+		msg = unmarshal(data, &message.ToRadio{})
+	default:
+		msg = unmarshal(data, &message.FromRadio{})
+		dir = capture.DIR_RX
+		if msg == nil {
+			msg = unmarshal(data, &message.ToRadio{})
+			dir = capture.DIR_TX
+		}
+	}
+	if msg == nil {
+		fmt.Fprintf(d.w, "could not decode %d bytes: %s\n", len(data), hex.EncodeToString(data))
+		return
+	}
+	fmt.Fprintf(d.w, "%s %d bytes ", dir, len(data))
+	Print(d.w, msg)
+}
+
+// unmarshal returns nil unless data is a valid msg with a variant set and no unknown fields
+func unmarshal(data []byte, msg proto.Message) proto.Message {
+	err := proto.Unmarshal(data, msg)
+	if err != nil || len(msg.ProtoReflect().GetUnknown()) > 0 {
+		return nil
+	}
+	oneof := msg.ProtoReflect().Descriptor().Oneofs().ByName("variant")
+	if oneof == nil || msg.ProtoReflect().WhichOneof(oneof) == nil {
+		return nil
+	}
+	return msg
+}
@@ -0,0 +1,142 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/capture"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	"github.com/nerdoftech/Meshtastic-go/pkg/serial"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestDecode(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Decode Suite")
+}
+
+func marshal(pb proto.Message) []byte {
+	data, err := proto.Marshal(pb)
+	if err != nil {
+		log.WithError(err).Fatal("error creating pb")
+	}
+	return data
+}
+
+func frame(data []byte) []byte {
+	return append([]byte{serial.START1, serial.START2, byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+var _ = Describe("decode", func() {
+	posPacket := marshal(&message.FromRadio{
+		Num: 3,
+		Variant: &message.FromRadio_Packet{Packet: &message.MeshPacket{
+			From:   0x12345678,
+			To:     0xffffffff,
+			RxTime: 1594000000,
+			Payload: &message.MeshPacket_Decoded{Decoded: &message.SubPacket{
+				Payload: &message.SubPacket_Position{Position: &message.Position{
+					LatitudeI:  374219999,
+					LongitudeI: -1220840575,
+				}},
+			}},
+		}},
+	})
+	wantConfig := marshal(&message.ToRadio{
+		Variant: &message.ToRadio_WantConfigId{WantConfigId: 42},
+	})
+	var out *bytes.Buffer
+	var d *Decoder
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		d = NewDecoder(out, "")
+	})
+	Context("Print", func() {
+		It("should show nested payloads with node ids and degrees", func() {
+			Print(out, &message.FromRadio{Variant: &message.FromRadio_Packet{Packet: &message.MeshPacket{
+				From: 0x12345678,
+				Payload: &message.MeshPacket_Decoded{Decoded: &message.SubPacket{
+					Payload: &message.SubPacket_Position{Position: &message.Position{LatitudeI: 374219999, Time: 1594000000}},
+				}},
+			}}})
+			Expect(out.String()).Should(Equal(strings.Join([]string{
+				"FromRadio",
+				"  packet: MeshPacket",
+				"    from: 305419896 (!12345678)",
+				"    decoded: SubPacket",
+				"      position: Position",
+				"        latitude_i: 374219999 (37.4219999)",
+				"        time: 1594000000 (2020-07-06T01:46:40Z)",
+				"",
+			}, "\n")))
+		})
+		It("should use enum names", func() {
+			Print(out, &message.SubPacket{
+				Payload: &message.SubPacket_Data{Data: &message.Data{Typ: message.Data_CLEAR_TEXT, Payload: []byte("hi")}},
+			})
+			Print(out, &message.SubPacket{Payload: &message.SubPacket_RouteError{RouteError: message.RouteError_NO_ROUTE}})
+			Print(out, &message.ChannelSettings{ModemConfig: message.ChannelSettings_Bw125Cr48Sf4096})
+			Expect(out.String()).Should(ContainSubstring("typ: CLEAR_TEXT\n"))
+			Expect(out.String()).Should(ContainSubstring("payload: 6869\n"))
+			Expect(out.String()).Should(ContainSubstring("route_error: NO_ROUTE\n"))
+			Expect(out.String()).Should(ContainSubstring("modem_config: Bw125Cr48Sf4096\n"))
+		})
+	})
+	Context("Message", func() {
+		It("should tell FromRadio and ToRadio apart", func() {
+			d.Message("", posPacket)
+			d.Message("", wantConfig)
+			Expect(out.String()).Should(ContainSubstring(fmt.Sprintf("rx %d bytes FromRadio\n", len(posPacket))))
+			Expect(out.String()).Should(ContainSubstring("tx 3 bytes ToRadio\n  want_config_id: 42\n"))
+		})
+		It("should report garbage", func() {
+			d.Message(capture.DIR_RX, []byte{0xff, 0xff})
+			Expect(out.String()).Should(Equal("could not decode 2 bytes: ffff\n"))
+		})
+	})
+	Context("Decode", func() {
+		It("should read hex lines with and without serial headers", func() {
+			in := hex.EncodeToString(wantConfig) + "\n\n" + "0x94 0xc3 " + hex.EncodeToString(frame(posPacket)[2:]) + "\n"
+			Expect(d.Decode(strings.NewReader(in), FORMAT_HEX)).Should(Succeed())
+			Expect(out.String()).Should(ContainSubstring("want_config_id: 42"))
+			Expect(out.String()).Should(ContainSubstring("longitude_i: -1220840575 (-122.0840575)"))
+		})
+		It("should read base64 frames split over lines", func() {
+			f := frame(posPacket)
+			in := base64.StdEncoding.EncodeToString(f[:10]) + "\n" + base64.StdEncoding.EncodeToString(f[10:]) + "\n"
+			Expect(d.Decode(strings.NewReader(in), FORMAT_BASE64)).Should(Succeed())
+			Expect(out.String()).Should(ContainSubstring("rx_time: 1594000000 (2020-07-06T01:46:40Z)"))
+			Expect(out.String()).ShouldNot(ContainSubstring("incomplete"))
+		})
+		It("should read raw serial bytes with console output", func() {
+			in := []byte("Booting\r\n")
+			in = append(in, frame(posPacket)...)
+			in = append(in, []byte("lora ok\n")...)
+			in = append(in, frame(wantConfig)[:4]...)
+			Expect(d.Decode(bytes.NewReader(in), FORMAT_RAW)).Should(Succeed())
+			lines := strings.Split(out.String(), "\n")
+			Expect(lines[0]).Should(Equal("console: Booting"))
+			Expect(lines[1]).Should(Equal(fmt.Sprintf("rx %d bytes FromRadio", len(posPacket))))
+			Expect(out.String()).Should(ContainSubstring("console: lora ok\nincomplete frame: 94c30003\n"))
+		})
+		It("should read captures", func() {
+			buf := &bytes.Buffer{}
+			w := capture.NewWriter(buf)
+			Expect(w.Write(capture.DIR_TX, wantConfig)).Should(Succeed())
+			Expect(d.Decode(buf, FORMAT_CAPTURE)).Should(Succeed())
+			Expect(out.String()).Should(MatchRegexp(`^\d\d:\d\d:\d\d\.\d{3} tx 3 bytes ToRadio`))
+		})
+		It("should reject unknown formats", func() {
+			Expect(d.Decode(strings.NewReader(""), Format("pb"))).Should(Equal(ErrUnknownFormat))
+		})
+	})
+})
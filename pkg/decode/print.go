@@ -0,0 +1,110 @@
+package decode
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+)
+
+const INDENT = "  "
+
+// Fields holding a node number, printed with the !xxxxxxxx form too
+var nodeFields = map[protoreflect.FullName]bool{
+	"MeshPacket.from":        true,
+	"MeshPacket.to":          true,
+	"NodeInfo.num":           true,
+	"NodeInfo.next_hop":      true,
+	"MyNodeInfo.my_node_num": true,
+	"SubPacket.dest":         true,
+	"SubPacket.source":       true,
+	"RouteDiscovery.route":   true,
+}
+
+// Fields holding seconds since 1970
+var timeFields = map[protoreflect.FullName]bool{
+	"Position.time":      true,
+	"MeshPacket.rx_time": true,
+}
+
+// Fields holding degrees * mesh.DEGREES_SCALE
+var degreeFields = map[protoreflect.FullName]bool{
+	"Position.latitude_i":  true,
+	"Position.longitude_i": true,
+}
+
+// Print writes every populated field of m, one per line, with enum names and nested messages indented
+func Print(w io.Writer, m protoreflect.ProtoMessage) {
+	msg := m.ProtoReflect()
+	fmt.Fprintf(w, "%s\n", msg.Descriptor().Name())
+	printMessage(w, msg, 1)
+}
+
+func printMessage(w io.Writer, msg protoreflect.Message, depth int) {
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !msg.Has(fd) {
+			continue
+		}
+		v := msg.Get(fd)
+		if fd.IsList() {
+			list := v.List()
+			for j := 0; j < list.Len(); j++ {
+				printField(w, fd, list.Get(j), depth)
+			}
+			continue
+		}
+		printField(w, fd, v, depth)
+	}
+}
+
+func printField(w io.Writer, fd protoreflect.FieldDescriptor, v protoreflect.Value, depth int) {
+	pre := strings.Repeat(INDENT, depth)
+	if fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+		fmt.Fprintf(w, "%s%s: %s\n", pre, fd.Name(), fd.Message().Name())
+		printMessage(w, v.Message(), depth+1)
+		return
+	}
+	fmt.Fprintf(w, "%s%s: %s\n", pre, fd.Name(), formatValue(fd, v))
+}
+
+func formatValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return fmt.Sprintf("%d", v.Enum())
+	case protoreflect.BytesKind:
+		return hex.EncodeToString(v.Bytes())
+	case protoreflect.StringKind:
+		return fmt.Sprintf("%q", v.String())
+	}
+
+	s := fmt.Sprint(v.Interface())
+	name := fd.FullName()
+	switch {
+	case nodeFields[name]:
+		s += fmt.Sprintf(" (!%08x)", nodeNum(fd, v))
+	case timeFields[name]:
+		s += fmt.Sprintf(" (%s)", time.Unix(int64(v.Uint()), 0).UTC().Format(time.RFC3339))
+	case degreeFields[name]:
+		s += fmt.Sprintf(" (%.7f)", float64(v.Int())/mesh.DEGREES_SCALE)
+	}
+	return s
+}
+
+// nodeNum handles RouteDiscovery.route being int32 while the others are uint32
+func nodeNum(fd protoreflect.FieldDescriptor, v protoreflect.Value) uint32 {
+	switch fd.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return uint32(v.Int())
+	}
+	return uint32(v.Uint())
+}
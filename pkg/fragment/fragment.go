@@ -0,0 +1,411 @@
+package fragment
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// First byte of every fragment layer payload, other Data_OPAQUE payloads are ignored
+	MAGIC = 0xfa
+
+	KIND_DATA byte = 1 // index, count and a slice of the message
+	KIND_NACK byte = 2 // indexes the receiver is missing
+	KIND_DONE byte = 3 // the receiver has the whole message
+
+	// magic, kind and message id
+	HEADER_LEN = 6
+	// HEADER_LEN, index and count
+	DATA_HEADER_LEN = HEADER_LEN + 4
+
+	// What the SubPacket and Data around an opaque payload over 127 bytes take
+	SUBPACKET_OVERHEAD = 6
+	// Message bytes per fragment, so a fragment fits mesh.DATA_PAYLOAD_LEN
+	FRAGMENT_LEN  = mesh.DATA_PAYLOAD_LEN - SUBPACKET_OVERHEAD - DATA_HEADER_LEN
+	MAX_FRAGMENTS = 0xffff
+
+	// Largest message accepted for reassembly, see WithMaxSize
+	MAX_MESSAGE_LEN = 1 << 20
+
+	// How long the receiver waits for the next fragment before re-requesting
+	// the missing ones, and the sender waits for DONE before resending the last one
+	NACK_TIMEOUT = 30 * time.Second
+	// Re-requests before a message is given up
+	MAX_NACKS = 3
+
+	// How long sent messages are kept to answer re-requests, and completed ones remembered to drop duplicates
+	KEEP_TIME = 10 * time.Minute
+)
+
+var (
+	ErrTooLarge = errors.New("message needs more than MAX_FRAGMENTS fragments")
+	ErrNoAnswer = errors.New("receiver did not confirm the message")
+)
+
+// Link is what the layer sends and receives Data_OPAQUE payloads with, *mesh.Mesh implements it
+type Link interface {
+	SendData(to uint32, payload []byte, opts ...mesh.DataOption) (uint32, error)
+	HandleData(typ message.Data_Type, fn func(pkt *message.MeshPacket, payload []byte))
+}
+
+// Option configures a Layer
+type Option func(*Layer)
+
+// WithLogger sends logs to l instead of the logrus standard logger
+func WithLogger(l log.FieldLogger) Option {
+	return func(f *Layer) {
+		f.logger = l
+	}
+}
+
+// WithNackTimeout sets how long to wait for progress before re-requesting, NACK_TIMEOUT by default
+func WithNackTimeout(d time.Duration) Option {
+	return func(f *Layer) {
+		f.nackTimeout = d
+	}
+}
+
+// WithMaxSize sets the largest message accepted for reassembly, MAX_MESSAGE_LEN by default
+func WithMaxSize(n int) Option {
+	return func(f *Layer) {
+		f.maxSize = n
+	}
+}
+
+// WithGap waits d between fragments, so a long message does not overflow the radio's transmit queue
+func WithGap(d time.Duration) Option {
+	return func(f *Layer) {
+		f.gap = d
+	}
+}
+
+type msgKey struct {
+	node uint32 // sender
+	id   uint32
+}
+
+// outgoing is a sent message kept to answer re-requests
+type outgoing struct {
+	to       uint32
+	frags    [][]byte
+	done     chan struct{}
+	progress chan struct{} // a fragment was resent for a re-request
+	expire   *time.Timer
+}
+
+// incoming is a message being reassembled
+type incoming struct {
+	frags [][]byte
+	have  int
+	nacks int
+	timer *time.Timer
+}
+
+// Layer splits large payloads into Data_OPAQUE fragments and puts them back together
+type Layer struct {
+	link        Link
+	logger      log.FieldLogger
+	nackTimeout time.Duration
+	maxSize     int
+	gap         time.Duration
+	msgID       uint32
+
+	mu        sync.Mutex
+	sent      map[uint32]*outgoing // by message id
+	recv      map[msgKey]*incoming
+	completed map[msgKey]time.Time
+	handlers  []func(from uint32, payload []byte)
+}
+
+// NewLayer starts handling fragments received on link
+func NewLayer(link Link, opts ...Option) *Layer {
+	f := &Layer{
+		link:        link,
+		logger:      log.StandardLogger(),
+		nackTimeout: NACK_TIMEOUT,
+		maxSize:     MAX_MESSAGE_LEN,
+		msgID:       rand.Uint32(),
+		sent:        make(map[uint32]*outgoing),
+		recv:        make(map[msgKey]*incoming),
+		completed:   make(map[msgKey]time.Time),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.logger = f.logger.WithField(mt.FIELD_COMPONENT, "fragment")
+	link.HandleData(message.Data_OPAQUE, f.handle)
+	return f
+}
+
+// OnLarge calls fn with each message reassembled from fragments
+func (f *Layer) OnLarge(fn func(from uint32, payload []byte)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers = append(f.handlers, fn)
+}
+
+// SendLarge sends payload to a node in fragments and waits until the node confirms it has the whole
+// message, resending what it asks for. Broadcasts return once sent, re-requests are still answered
+// for KEEP_TIME. Cancel ctx to stop waiting.
+func (f *Layer) SendLarge(ctx context.Context, to uint32, payload []byte) error {
+	count := (len(payload) + FRAGMENT_LEN - 1) / FRAGMENT_LEN
+	if count == 0 {
+		count = 1
+	}
+	if count > MAX_FRAGMENTS {
+		return ErrTooLarge
+	}
+	id := atomic.AddUint32(&f.msgID, 1)
+	out := &outgoing{to: to, frags: make([][]byte, count), done: make(chan struct{}), progress: make(chan struct{}, 1)}
+	for i := range out.frags {
+		end := (i + 1) * FRAGMENT_LEN
+		if end > len(payload) {
+			end = len(payload)
+		}
+		out.frags[i] = encodeData(id, uint16(i), uint16(count), payload[i*FRAGMENT_LEN:end])
+	}
+	f.mu.Lock()
+	f.sent[id] = out
+	out.expire = time.AfterFunc(KEEP_TIME, func() { f.forget(id) })
+	f.mu.Unlock()
+
+	logger := f.logger.WithField(mt.FIELD_NODE, to).WithField(mt.FIELD_MESSAGE_ID, id)
+	logger.WithField("fragments", count).Debug("sending message")
+	for i, frag := range out.frags {
+		if i > 0 && f.gap > 0 {
+			time.Sleep(f.gap)
+		}
+		_, err := f.link.SendData(to, frag)
+		if err != nil {
+			f.forget(id)
+			return err
+		}
+	}
+	if to == mesh.BROADCAST_ADDR {
+		return nil
+	}
+	defer f.forget(id)
+
+	// The receiver cannot ask for anything if it missed the last fragments, resend the last one to prompt it.
+	// Re-requests show the transfer is still going, the wait starts over with each resent fragment.
+	timer := time.NewTimer(f.nackTimeout)
+	defer timer.Stop()
+	tries := 0
+	for {
+		select {
+		case <-out.done:
+			logger.Debug("message confirmed")
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-out.progress:
+			tries = 0
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(f.nackTimeout)
+		case <-timer.C:
+			if tries == MAX_NACKS {
+				return ErrNoAnswer
+			}
+			tries++
+			logger.Debug("no answer, resending last fragment")
+			_, err := f.link.SendData(to, out.frags[count-1])
+			if err != nil {
+				return err
+			}
+			timer.Reset(f.nackTimeout)
+		}
+	}
+}
+
+func (f *Layer) forget(id uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if out, ok := f.sent[id]; ok {
+		out.expire.Stop()
+		delete(f.sent, id)
+	}
+}
+
+// handle is the Data_OPAQUE handler registered on the link
+func (f *Layer) handle(pkt *message.MeshPacket, payload []byte) {
+	if len(payload) < HEADER_LEN || payload[0] != MAGIC {
+		return
+	}
+	from := pkt.GetFrom()
+	id := binary.BigEndian.Uint32(payload[2:6])
+	switch payload[1] {
+	case KIND_DATA:
+		if len(payload) < DATA_HEADER_LEN {
+			return
+		}
+		idx := binary.BigEndian.Uint16(payload[6:8])
+		count := binary.BigEndian.Uint16(payload[8:10])
+		f.handleFragment(msgKey{from, id}, int(idx), int(count), payload[DATA_HEADER_LEN:])
+	case KIND_NACK:
+		missing := make([]int, 0, (len(payload)-HEADER_LEN)/2)
+		for i := HEADER_LEN; i+2 <= len(payload); i += 2 {
+			missing = append(missing, int(binary.BigEndian.Uint16(payload[i:])))
+		}
+		// Resending can take a while with a gap, do not hold up the receive loop
+		go f.handleNack(from, id, missing)
+	case KIND_DONE:
+		f.mu.Lock()
+		out, ok := f.sent[id]
+		if ok && out.to == from {
+			select {
+			case <-out.done:
+			default:
+				close(out.done)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *Layer) handleFragment(k msgKey, idx, count int, data []byte) {
+	logger := f.logger.WithField(mt.FIELD_NODE, k.node).WithField(mt.FIELD_MESSAGE_ID, k.id)
+	if count == 0 || idx >= count || count*FRAGMENT_LEN > f.maxSize+FRAGMENT_LEN {
+		logger.WithField("index", idx).WithField("count", count).Warn("dropping invalid fragment")
+		return
+	}
+	f.mu.Lock()
+	if _, ok := f.completed[k]; ok {
+		f.mu.Unlock()
+		// Our DONE got lost, the sender is still asking
+		f.send(k.node, encode(KIND_DONE, k.id, nil))
+		return
+	}
+	in, ok := f.recv[k]
+	if !ok {
+		in = &incoming{frags: make([][]byte, count)}
+		in.timer = time.AfterFunc(f.nackTimeout, func() { f.stalled(k) })
+		f.recv[k] = in
+	}
+	if len(in.frags) != count {
+		f.mu.Unlock()
+		logger.Warn("fragment count changed, dropping fragment")
+		return
+	}
+	if in.frags[idx] == nil {
+		in.frags[idx] = append([]byte{}, data...)
+		in.have++
+		in.nacks = 0
+	}
+	in.timer.Reset(f.nackTimeout)
+	if in.have < count {
+		f.mu.Unlock()
+		return
+	}
+	in.timer.Stop()
+	delete(f.recv, k)
+	f.complete(k)
+	handlers := f.handlers
+	f.mu.Unlock()
+
+	msg := make([]byte, 0, count*FRAGMENT_LEN)
+	for _, frag := range in.frags {
+		msg = append(msg, frag...)
+	}
+	logger.WithField(mt.FIELD_PACKET_LEN, len(msg)).Debug("message reassembled")
+	f.send(k.node, encode(KIND_DONE, k.id, nil))
+	for _, fn := range handlers {
+		fn(k.node, msg)
+	}
+}
+
+// complete remembers k to drop duplicates, must hold mu
+func (f *Layer) complete(k msgKey) {
+	now := time.Now()
+	for ck, t := range f.completed {
+		if now.Sub(t) > KEEP_TIME {
+			delete(f.completed, ck)
+		}
+	}
+	f.completed[k] = now
+}
+
+// stalled runs when no fragment of k arrived for nackTimeout
+func (f *Layer) stalled(k msgKey) {
+	logger := f.logger.WithField(mt.FIELD_NODE, k.node).WithField(mt.FIELD_MESSAGE_ID, k.id)
+	f.mu.Lock()
+	in, ok := f.recv[k]
+	if !ok {
+		f.mu.Unlock()
+		return
+	}
+	if in.nacks == MAX_NACKS {
+		delete(f.recv, k)
+		f.mu.Unlock()
+		logger.WithField("missing", len(in.frags)-in.have).Warn("giving up on message")
+		return
+	}
+	in.nacks++
+	// As many indexes as fit one packet, the next round asks for the rest
+	missing := make([]byte, 0, FRAGMENT_LEN)
+	for i, frag := range in.frags {
+		if frag == nil && len(missing)+2 <= FRAGMENT_LEN {
+			missing = append(missing, byte(i>>8), byte(i))
+		}
+	}
+	in.timer.Reset(f.nackTimeout)
+	f.mu.Unlock()
+	logger.WithField("missing", len(missing)/2).Debug("re-requesting fragments")
+	f.send(k.node, encode(KIND_NACK, k.id, missing))
+}
+
+// handleNack resends the fragments a receiver asked for
+func (f *Layer) handleNack(from, id uint32, missing []int) {
+	f.mu.Lock()
+	out, ok := f.sent[id]
+	f.mu.Unlock()
+	if !ok || (out.to != from && out.to != mesh.BROADCAST_ADDR) {
+		f.logger.WithField(mt.FIELD_NODE, from).WithField(mt.FIELD_MESSAGE_ID, id).Debug("re-request for unknown message")
+		return
+	}
+	for i, idx := range missing {
+		if idx >= len(out.frags) {
+			continue
+		}
+		if i > 0 && f.gap > 0 {
+			time.Sleep(f.gap)
+		}
+		f.send(from, out.frags[idx])
+		select {
+		case out.progress <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (f *Layer) send(to uint32, payload []byte) {
+	_, err := f.link.SendData(to, payload)
+	if err != nil {
+		f.logger.WithField(mt.FIELD_NODE, to).WithError(err).Error("could not send fragment layer packet")
+	}
+}
+
+func encode(kind byte, id uint32, body []byte) []byte {
+	b := make([]byte, HEADER_LEN, HEADER_LEN+len(body))
+	b[0], b[1] = MAGIC, kind
+	binary.BigEndian.PutUint32(b[2:], id)
+	return append(b, body...)
+}
+
+func encodeData(id uint32, idx, count uint16, data []byte) []byte {
+	b := encode(KIND_DATA, id, make([]byte, 4, 4+len(data)))
+	binary.BigEndian.PutUint16(b[6:], idx)
+	binary.BigEndian.PutUint16(b[8:], count)
+	return append(b, data...)
+}
@@ -0,0 +1,202 @@
+package fragment
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestFragment(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fragment Suite")
+}
+
+var logger = func() *log.Logger {
+	l := log.New()
+	l.SetLevel(log.DebugLevel)
+	return l
+}()
+
+// fakeLink delivers to its peer in order, like two radios in range of each other
+type fakeLink struct {
+	num      uint32
+	peer     *fakeLink
+	queue    chan []byte
+	mu       sync.Mutex
+	handlers []func(*message.MeshPacket, []byte)
+	sent     [][]byte
+	drop     func(payload []byte) bool // lose a packet on the way
+}
+
+func newPair() (*fakeLink, *fakeLink) {
+	a := &fakeLink{num: 1, queue: make(chan []byte, 100)}
+	b := &fakeLink{num: 2, queue: make(chan []byte, 100)}
+	a.peer, b.peer = b, a
+	go a.deliver()
+	go b.deliver()
+	return a, b
+}
+
+func (l *fakeLink) deliver() {
+	for payload := range l.queue {
+		l.peer.mu.Lock()
+		handlers := l.peer.handlers
+		l.peer.mu.Unlock()
+		for _, fn := range handlers {
+			fn(&message.MeshPacket{From: l.num, To: l.peer.num}, payload)
+		}
+	}
+}
+
+func (l *fakeLink) SendData(to uint32, payload []byte, opts ...mesh.DataOption) (uint32, error) {
+	sub := &message.SubPacket{Payload: &message.SubPacket_Data{Data: &message.Data{Payload: payload}}}
+	if proto.Size(sub) > mesh.DATA_PAYLOAD_LEN {
+		return 0, mesh.ErrPayloadTooLarge
+	}
+	l.mu.Lock()
+	l.sent = append(l.sent, payload)
+	drop := l.drop != nil && l.drop(payload)
+	l.mu.Unlock()
+	if !drop {
+		l.queue <- payload
+	}
+	return 1, nil
+}
+
+func (l *fakeLink) HandleData(typ message.Data_Type, fn func(*message.MeshPacket, []byte)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers = append(l.handlers, fn)
+}
+
+func (l *fakeLink) kinds() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	res := []byte{}
+	for _, p := range l.sent {
+		res = append(res, p[1])
+	}
+	return res
+}
+
+// dropOnce loses the fragments with the given indexes the first time they are sent
+func dropOnce(idx ...int) func([]byte) bool {
+	seen := make(map[int]bool)
+	return func(p []byte) bool {
+		if p[1] != KIND_DATA {
+			return false
+		}
+		i := int(p[6])<<8 | int(p[7])
+		for _, d := range idx {
+			if d == i && !seen[i] {
+				seen[i] = true
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var _ = Describe("fragment", func() {
+	var la, lb *fakeLink
+	var a, b *Layer
+	var got chan []byte
+	payload := make([]byte, 4*FRAGMENT_LEN+10)
+	rand.Read(payload)
+	BeforeEach(func() {
+		la, lb = newPair()
+		opts := []Option{WithLogger(logger), WithNackTimeout(20 * time.Millisecond)}
+		a = NewLayer(la, opts...)
+		b = NewLayer(lb, opts...)
+		got = make(chan []byte, 2)
+		b.OnLarge(func(from uint32, p []byte) {
+			// Callbacks run on the link goroutines, check the sender through got
+			if from == 1 {
+				got <- p
+			}
+		})
+	})
+	It("should send large payloads in fragments that fit a packet", func() {
+		Expect(a.SendLarge(context.Background(), 2, payload)).Should(Succeed())
+		Eventually(got).Should(Receive(Equal(payload)))
+		Expect(la.kinds()).Should(Equal([]byte{KIND_DATA, KIND_DATA, KIND_DATA, KIND_DATA, KIND_DATA}))
+		Expect(lb.kinds()).Should(Equal([]byte{KIND_DONE}))
+	})
+	It("should send empty payloads", func() {
+		Expect(a.SendLarge(context.Background(), 2, nil)).Should(Succeed())
+		Eventually(got).Should(Receive(BeEmpty()))
+	})
+	It("should re-request missing fragments", func() {
+		la.drop = dropOnce(1, 3)
+		Expect(a.SendLarge(context.Background(), 2, payload)).Should(Succeed())
+		Eventually(got).Should(Receive(Equal(payload)))
+		// Timing may add a second NACK before the resent fragments arrive
+		kinds := lb.kinds()
+		Expect(kinds[0]).Should(Equal(KIND_NACK))
+		Expect(kinds[len(kinds)-1]).Should(Equal(KIND_DONE))
+		Expect(lb.sent[0][HEADER_LEN:]).Should(Equal([]byte{0, 1, 0, 3}))
+	})
+	It("should recover when every fragment is lost once", func() {
+		la.drop = dropOnce(0, 1, 2, 3, 4)
+		Expect(a.SendLarge(context.Background(), 2, payload)).Should(Succeed())
+		Eventually(got).Should(Receive(Equal(payload)))
+	})
+	It("should keep waiting while lost fragments are resent", func() {
+		a = NewLayer(la, WithLogger(logger), WithNackTimeout(20*time.Millisecond), WithGap(5*time.Millisecond))
+		big := make([]byte, 30*FRAGMENT_LEN)
+		rand.Read(big)
+		lost := make([]int, 29)
+		for i := range lost {
+			lost[i] = i
+		}
+		la.drop = dropOnce(lost...)
+		// Resending takes longer than MAX_NACKS+1 timeouts
+		Expect(a.SendLarge(context.Background(), 2, big)).Should(Succeed())
+		Eventually(got).Should(Receive(Equal(big)))
+	})
+	It("should give up without an answer", func() {
+		la.drop = func([]byte) bool { return true }
+		Expect(a.SendLarge(context.Background(), 2, payload)).Should(Equal(ErrNoAnswer))
+		Expect(la.kinds()).Should(HaveLen(5 + MAX_NACKS))
+	})
+	It("should stop waiting when ctx is done", func() {
+		la.drop = func([]byte) bool { return true }
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(a.SendLarge(ctx, 2, payload)).Should(Equal(context.Canceled))
+	})
+	It("should not send broadcasts twice or wait for them", func() {
+		Expect(a.SendLarge(context.Background(), mesh.BROADCAST_ADDR, payload[:10])).Should(Succeed())
+		Eventually(got).Should(Receive(Equal(payload[:10])))
+	})
+	It("should deliver duplicates once and confirm again", func() {
+		Expect(a.SendLarge(context.Background(), 2, payload[:10])).Should(Succeed())
+		Eventually(got).Should(Receive())
+		la.queue <- la.sent[0]
+		Eventually(lb.kinds).Should(Equal([]byte{KIND_DONE, KIND_DONE}))
+		Consistently(got, 50*time.Millisecond).ShouldNot(Receive())
+	})
+	It("should ignore other opaque payloads and oversized messages", func() {
+		b.handle(&message.MeshPacket{From: 1}, []byte{1, 2, 3, 4, 5, 6, 7})
+		small := NewLayer(lb, WithLogger(logger), WithMaxSize(100))
+		small.OnLarge(func(uint32, []byte) { got <- nil })
+		Expect(a.SendLarge(context.Background(), 2, bytes.Repeat([]byte{1}, 3*FRAGMENT_LEN))).Should(Succeed())
+		Eventually(got).Should(Receive(HaveLen(3 * FRAGMENT_LEN)))
+		Consistently(got, 50*time.Millisecond).ShouldNot(Receive())
+	})
+	It("should refuse messages with too many fragments", func() {
+		Expect(a.SendLarge(context.Background(), 2, make([]byte, FRAGMENT_LEN*MAX_FRAGMENTS+1))).Should(Equal(ErrTooLarge))
+	})
+})
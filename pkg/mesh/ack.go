@@ -0,0 +1,48 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+)
+
+// ackTracker remembers when packets that want an ack were sent
+type ackTracker struct {
+	mu      sync.Mutex
+	pending map[uint32]ackEntry
+}
+
+type ackEntry struct {
+	sent    time.Time
+	expires time.Time
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{
+		pending: make(map[uint32]ackEntry),
+	}
+}
+
+// sent records packet id, entries older than timeout are dropped
+func (a *ackTracker) sent(id uint32, timeout time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for k, e := range a.pending {
+		if now.After(e.expires) {
+			delete(a.pending, k)
+		}
+	}
+	a.pending[id] = ackEntry{sent: now, expires: now.Add(timeout)}
+}
+
+// acked removes packet id and returns how long ago it was sent
+func (a *ackTracker) acked(id uint32) (time.Duration, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.pending[id]
+	if !ok {
+		return 0, false
+	}
+	delete(a.pending, id)
+	return time.Since(e.sent), true
+}
@@ -0,0 +1,111 @@
+package mesh
+
+import (
+	"errors"
+	"io/ioutil"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+)
+
+// Backups hold the channel PSK, keep them private
+const BACKUP_FILE_MODE = 0600
+
+var ErrNoConfig = errors.New("radio config has not been received")
+
+// SetOwner sets the user name of the radio
+func (m *Mesh) SetOwner(user *message.User) error {
+	if m.Compat() {
+		return ErrCompatMode
+	}
+	msg := &message.ToRadio{
+		Variant: &message.ToRadio_SetOwner{
+			SetOwner: user,
+		},
+	}
+	return m.sendToRadio(msg)
+}
+
+// GetOwner returns the user of our own radio from the node list, nil until the config was received
+func (m *Mesh) GetOwner() *message.User {
+	num := m.GetMyNodeInfo().GetMyNodeNum()
+	m.nodeMu.Lock()
+	defer m.nodeMu.Unlock()
+	return m.nodes[num].GetUser()
+}
+
+// Backup assembles a DeviceState from what the radio sent on Connect.
+// ReceiveQueue is left empty, packets are delivered to subscribers instead of queued.
+func (m *Mesh) Backup() (*message.DeviceState, error) {
+	info := m.GetMyNodeInfo()
+	radio := m.GetRadioConfig()
+	if info == nil || radio == nil {
+		return nil, ErrNoConfig
+	}
+	ds := &message.DeviceState{
+		Radio:  radio,
+		MyNode: info,
+		Owner:  m.GetOwner(),
+		NodeDb: m.nodeList(false),
+	}
+	return ds, nil
+}
+
+// BackupToFile writes Backup to path as a binary DeviceState protobuf
+func (m *Mesh) BackupToFile(path string) error {
+	ds, err := m.Backup()
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(ds)
+	if err != nil {
+		return err
+	}
+	m.logger.WithField(mt.FIELD_PATH, path).Info("writing device backup")
+	return ioutil.WriteFile(path, data, BACKUP_FILE_MODE)
+}
+
+// LoadBackup reads a file written by BackupToFile
+func LoadBackup(path string) (*message.DeviceState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ds := &message.DeviceState{}
+	err = proto.Unmarshal(data, ds)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// Restore applies the radio config and owner of ds, e.g. to set up replacement hardware.
+// The owner's Id and Macaddr belong to the old hardware, only the names are applied.
+func (m *Mesh) Restore(ds *message.DeviceState) error {
+	if ds.GetRadio() == nil {
+		return ErrNoConfig
+	}
+	err := m.SetRadioConfig(ds.GetRadio())
+	if err != nil {
+		return err
+	}
+	if ds.GetOwner() == nil {
+		return nil
+	}
+	return m.SetOwner(&message.User{
+		LongName:  ds.GetOwner().GetLongName(),
+		ShortName: ds.GetOwner().GetShortName(),
+	})
+}
+
+// RestoreFromFile is LoadBackup followed by Restore
+func (m *Mesh) RestoreFromFile(path string) error {
+	ds, err := LoadBackup(path)
+	if err != nil {
+		return err
+	}
+	m.logger.WithField(mt.FIELD_PATH, path).Info("restoring device backup")
+	return m.Restore(ds)
+}
@@ -0,0 +1,80 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+)
+
+// The largest encoded SubPacket the radio sends in one LoRa packet,
+// what is left of the 255 byte LoRa payload after the radio's header and encryption
+const DATA_PAYLOAD_LEN = 240
+
+// ErrPayloadTooLarge is returned by SendData when the packet would not fit DATA_PAYLOAD_LEN
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// DataOption configures SendData
+type DataOption func(*dataOptions)
+
+type dataOptions struct {
+	typ          message.Data_Type
+	wantAck      bool
+	wantResponse bool
+}
+
+// WithDataType sends the payload as typ instead of Data_OPAQUE
+func WithDataType(typ message.Data_Type) DataOption {
+	return func(o *dataOptions) {
+		o.typ = typ
+	}
+}
+
+// WithAck asks the mesh to deliver the packet reliably, see TOPIC_DATA for the ack
+func WithAck() DataOption {
+	return func(o *dataOptions) {
+		o.wantAck = true
+	}
+}
+
+// WithWantResponse asks the recipient to answer in kind
+func WithWantResponse() DataOption {
+	return func(o *dataOptions) {
+		o.wantResponse = true
+	}
+}
+
+// SendData sends an app defined payload to a node or BROADCAST_ADDR and returns the packet id.
+// Packets that would not fit DATA_PAYLOAD_LEN return ErrPayloadTooLarge.
+func (m *Mesh) SendData(to uint32, payload []byte, opts ...DataOption) (uint32, error) {
+	o := &dataOptions{typ: message.Data_OPAQUE}
+	for _, opt := range opts {
+		opt(o)
+	}
+	sub := &message.SubPacket{
+		Payload: &message.SubPacket_Data{
+			Data: &message.Data{Typ: o.typ, Payload: payload},
+		},
+		WantResponse: o.wantResponse,
+	}
+	if size := proto.Size(sub); size > DATA_PAYLOAD_LEN {
+		return 0, fmt.Errorf("%w: %d bytes encoded, the radio sends at most %d", ErrPayloadTooLarge, size, DATA_PAYLOAD_LEN)
+	}
+	m.logger.WithField(mt.FIELD_NODE, to).WithField(mt.FIELD_PACKET_LEN, len(payload)).Debug("sending data")
+	return m.sendPacket(to, sub, o.wantAck)
+}
+
+// HandleData calls fn with each received Data payload of typ, e.g. Data_OPAQUE for app protocols
+func (m *Mesh) HandleData(typ message.Data_Type, fn func(pkt *message.MeshPacket, payload []byte)) {
+	m.Subscribe(TOPIC_DATA, func(p interface{}) {
+		pkt := p.(*message.MeshPacket)
+		data := pkt.GetDecoded().GetData()
+		if data == nil || data.GetTyp() != typ {
+			return
+		}
+		fn(pkt, data.GetPayload())
+	})
+}
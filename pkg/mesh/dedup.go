@@ -0,0 +1,83 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+)
+
+const (
+	// How long a packet is remembered to drop copies of it, see WithDedupWindow
+	DEDUP_WINDOW = 10 * time.Minute
+
+	// Bounds of the dedup cache. Within them it holds half the packet id space, so
+	// a sender's ids cannot wrap around into ones still remembered.
+	DEDUP_MIN_SIZE = 64
+	DEDUP_MAX_SIZE = 4096
+)
+
+type dedupKey struct {
+	from, id uint32
+}
+
+type dedupEntry struct {
+	key  dedupKey
+	seen time.Time
+}
+
+// dedupCache remembers the packets received within a window, oldest first
+type dedupCache struct {
+	mu    sync.Mutex
+	seen  map[dedupKey]time.Time
+	order []dedupEntry
+}
+
+// duplicate records the packet and returns true if it was already seen within window
+func (c *dedupCache) duplicate(from, id uint32, window time.Duration, size int, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[dedupKey]time.Time)
+	}
+	for len(c.order) > 0 && (len(c.order) >= size || now.Sub(c.order[0].seen) > window) {
+		delete(c.seen, c.order[0].key)
+		c.order = c.order[1:]
+	}
+	k := dedupKey{from, id}
+	if _, ok := c.seen[k]; ok {
+		return true
+	}
+	c.seen[k] = now
+	c.order = append(c.order, dedupEntry{k, now})
+	return false
+}
+
+// dedupSize is half the packet id space, within DEDUP_MIN_SIZE and DEDUP_MAX_SIZE
+func dedupSize(info *message.MyNodeInfo) int {
+	bits := info.GetPacketIdBits()
+	if bits == 0 {
+		bits = 8
+	}
+	if bits > 13 {
+		return DEDUP_MAX_SIZE
+	}
+	size := 1 << (bits - 1)
+	if size < DEDUP_MIN_SIZE {
+		return DEDUP_MIN_SIZE
+	}
+	return size
+}
+
+// isDuplicate is true for a packet already handed to subscribers.
+// Packets without an id cannot be told apart and are never dropped.
+func (m *Mesh) isDuplicate(pkt *message.MeshPacket) bool {
+	if m.dedupWindow <= 0 || pkt.GetId() == 0 {
+		return false
+	}
+	if !m.dedup.duplicate(pkt.GetFrom(), pkt.GetId(), m.dedupWindow, dedupSize(m.GetMyNodeInfo()), time.Now()) {
+		return false
+	}
+	m.stats.DuplicateDropped(pkt.GetFrom())
+	return true
+}
@@ -0,0 +1,93 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/serial"
+)
+
+const (
+	// How long a candidate port gets to answer WantConfigId
+	PROBE_TIMEOUT = 3 * time.Second
+	SYSFS_ROOT    = "/"
+)
+
+// Device is a radio found by Discover
+type Device struct {
+	Path            string
+	Bridge          string // USB serial bridge, see serial.KNOWN_USB_IDS
+	HwModel         string
+	FirmwareVersion string
+	MyNodeNum       uint32
+}
+
+// probeDevice is swapped out by tests, there is no radio on the build machine
+var probeDevice func(path string, opts ...Option) (*Device, error)
+
+func init() {
+	// Set here rather than in the declaration, probe -> NewMesh -> Discover would be an initialization cycle
+	probeDevice = probe
+}
+
+// Discover finds serial ports with a known USB bridge and probes each with a
+// WantConfigId exchange, returning the ones that answered like a radio.
+// opts are used for the probe connections, e.g. WithLogger.
+func Discover(opts ...Option) ([]Device, error) {
+	return discover(SYSFS_ROOT, opts...)
+}
+
+func discover(root string, opts ...Option) ([]Device, error) {
+	cands, err := serial.Candidates(root)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*Device, len(cands))
+	wg := &sync.WaitGroup{}
+	for i, c := range cands {
+		wg.Add(1)
+		go func(i int, c serial.Candidate) {
+			defer wg.Done()
+			dev, err := probeDevice(c.Path, opts...)
+			if err != nil {
+				return
+			}
+			dev.Bridge = c.Bridge
+			found[i] = dev
+		}(i, c)
+	}
+	wg.Wait()
+
+	res := make([]Device, 0, len(found))
+	for _, d := range found {
+		if d != nil {
+			res = append(res, *d)
+		}
+	}
+	return res, nil
+}
+
+func probe(path string, opts ...Option) (*Device, error) {
+	// Report radios with any firmware, Connect to them decides if they can be used
+	opts = append(opts, WithConfigTimeout(PROBE_TIMEOUT), WithCompatMode(COMPAT_DOWNGRADE))
+	m, err := NewMesh(path, TRANSPORT_SERIAL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m.logger.Debug("probing for radio")
+	err = m.Connect()
+	if err != nil {
+		m.logger.WithError(err).Debug("no radio answered")
+		return nil, err
+	}
+	defer m.Close()
+	info := m.GetMyNodeInfo()
+	dev := &Device{
+		Path:            path,
+		HwModel:         info.GetHwModel(),
+		FirmwareVersion: info.GetFirmwareVersion(),
+		MyNodeNum:       info.GetMyNodeNum(),
+	}
+	return dev, nil
+}
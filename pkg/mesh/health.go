@@ -0,0 +1,128 @@
+package mesh
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+)
+
+// FirmwareErrorCode is MyNodeInfo.ErrorCode, CriticalErrorCode in the device code
+type FirmwareErrorCode uint32
+
+const (
+	ERR_NONE FirmwareErrorCode = iota
+	ERR_TX_WATCHDOG
+	ERR_SLEEP_ENTER_WAIT
+	ERR_NO_RADIO
+	ERR_UNSPECIFIED
+	ERR_UBLOX_INIT_FAILED
+)
+
+func (c FirmwareErrorCode) String() string {
+	switch c {
+	case ERR_NONE:
+		return "None"
+	case ERR_TX_WATCHDOG:
+		return "TxWatchdog"
+	case ERR_SLEEP_ENTER_WAIT:
+		return "SleepEnterWait"
+	case ERR_NO_RADIO:
+		return "NoRadio"
+	case ERR_UNSPECIFIED:
+		return "Unspecified"
+	case ERR_UBLOX_INIT_FAILED:
+		return "UBloxInitFailed"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint32(c))
+}
+
+// FirmwareError is a critical fault the radio reported in MyNodeInfo
+type FirmwareError struct {
+	Node    uint32
+	Code    FirmwareErrorCode
+	Address uint32 // where in the firmware it happened
+	Count   uint32 // errors since the radio last discarded its preferences
+	Time    time.Time
+}
+
+func (e *FirmwareError) Error() string {
+	return fmt.Sprintf("radio !%08x firmware error %s at 0x%x (%d so far)", e.Node, e.Code, e.Address, e.Count)
+}
+
+// Health is a snapshot of the connection and of faults reported by the radio
+type Health struct {
+	State           mt.ConnState
+	FirmwareVersion string
+	Errors          uint32         // firmware errors seen since NewMesh
+	LastError       *FirmwareError // nil if there were none
+}
+
+// Healthy is false while disconnected or once the radio reported a fault
+func (h Health) Healthy() bool {
+	return h.State == mt.STATE_CONNECTED && h.Errors == 0
+}
+
+// healthTracker keeps the state Health reports
+type healthTracker struct {
+	state     int32 // mt.ConnState
+	mu        sync.Mutex
+	known     bool   // count holds a MyNodeInfo.ErrorCount
+	count     uint32 // last MyNodeInfo.ErrorCount
+	errors    uint32
+	lastError *FirmwareError
+}
+
+func (h *healthTracker) setState(st mt.ConnState) {
+	atomic.StoreInt32(&h.state, int32(st))
+}
+
+// update returns a FirmwareError if info reports more errors than last time.
+// ErrorCount is kept across reboots, the first one received is where we start
+// counting so faults from before NewMesh are not raised. It only goes down when
+// the radio discards its preferences.
+func (h *healthTracker) update(info *message.MyNodeInfo) *FirmwareError {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.known || info.GetErrorCount() <= h.count {
+		h.known = true
+		h.count = info.GetErrorCount()
+		return nil
+	}
+	h.errors += info.GetErrorCount() - h.count
+	h.count = info.GetErrorCount()
+	h.lastError = &FirmwareError{
+		Node:    info.GetMyNodeNum(),
+		Code:    FirmwareErrorCode(info.GetErrorCode()),
+		Address: info.GetErrorAddress(),
+		Count:   info.GetErrorCount(),
+		Time:    time.Now(),
+	}
+	return h.lastError
+}
+
+// checkFirmwareError raises TOPIC_FIRMWARE_ERROR when MyNodeInfo reports a new fault
+func (m *Mesh) checkFirmwareError(info *message.MyNodeInfo) {
+	fe := m.health.update(info)
+	if fe == nil {
+		return
+	}
+	m.logger.WithError(fe).Error("radio reported a firmware error")
+	m.stats.FirmwareError(fe.Node, fe.Code.String())
+	m.pub(TOPIC_FIRMWARE_ERROR, fe)
+}
+
+// Health returns the connection state and the faults the radio reported
+func (m *Mesh) Health() Health {
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+	return Health{
+		State:           mt.ConnState(atomic.LoadInt32(&m.health.state)),
+		FirmwareVersion: m.GetMyNodeInfo().GetFirmwareVersion(),
+		Errors:          m.health.errors,
+		LastError:       m.health.lastError,
+	}
+}
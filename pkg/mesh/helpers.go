@@ -1 +1,31 @@
 package mesh
+
+import (
+	"errors"
+	"math"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+)
+
+// Position LatitudeI/LongitudeI are degrees * 1e7
+const DEGREES_SCALE = 1e7
+
+// newPosition validates and converts a position given in degrees
+func newPosition(lat, lon float64, alt, battery int32) (*message.Position, error) {
+	if lat < -90 || lat > 90 {
+		return nil, errors.New("latitude out of range")
+	}
+	if lon < -180 || lon > 180 {
+		return nil, errors.New("longitude out of range")
+	}
+	if battery < 0 || battery > 100 {
+		return nil, errors.New("battery level out of range")
+	}
+	pos := &message.Position{
+		LatitudeI:    int32(math.Round(lat * DEGREES_SCALE)),
+		LongitudeI:   int32(math.Round(lon * DEGREES_SCALE)),
+		Altitude:     alt,
+		BatteryLevel: battery,
+	}
+	return pos, nil
+}
@@ -0,0 +1,86 @@
+package mesh
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+)
+
+// IgnoreNode adds num to UserPreferences.IgnoreIncoming, the radio drops what the node sends.
+// The node is also hidden from GetNodes, TOPIC_NODE and TOPIC_DATA.
+func (m *Mesh) IgnoreNode(num uint32) error {
+	return m.editIgnored(func(list []uint32) []uint32 {
+		for _, n := range list {
+			if n == num {
+				return list
+			}
+		}
+		return append(list, num)
+	})
+}
+
+// UnignoreNode removes num from UserPreferences.IgnoreIncoming
+func (m *Mesh) UnignoreNode(num uint32) error {
+	return m.editIgnored(func(list []uint32) []uint32 {
+		res := make([]uint32, 0, len(list))
+		for _, n := range list {
+			if n != num {
+				res = append(res, n)
+			}
+		}
+		return res
+	})
+}
+
+// ListIgnored returns the ignored node numbers, sorted
+func (m *Mesh) ListIgnored() []uint32 {
+	list := append([]uint32(nil), m.GetRadioConfig().GetPreferences().GetIgnoreIncoming()...)
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+// editIgnored writes the radio config back with the ignore list changed by edit.
+// It holds prefsMu like SetRadioConfig, which caches what was written, so the next
+// write starts from this one before the radio sends its config again.
+func (m *Mesh) editIgnored(edit func([]uint32) []uint32) error {
+	m.prefsMu.Lock()
+	defer m.prefsMu.Unlock()
+	cur := m.GetRadioConfig()
+	if cur == nil {
+		return ErrNoConfig
+	}
+	cfg := proto.Clone(cur).(*message.RadioConfig)
+	if cfg.Preferences == nil {
+		cfg.Preferences = &message.RadioConfig_UserPreferences{}
+	}
+	list := edit(append([]uint32(nil), cfg.Preferences.IgnoreIncoming...))
+	// Edits only add or remove, the same length means nothing changed
+	if len(list) == len(cfg.Preferences.IgnoreIncoming) {
+		return nil
+	}
+	cfg.Preferences.IgnoreIncoming = list
+	m.logger.WithField("ignored", list).Info("updating ignored nodes")
+	return m.setRadioConfig(cfg)
+}
+
+// isIgnored is true for nodes in the radio's IgnoreIncoming list
+func (m *Mesh) isIgnored(num uint32) bool {
+	for _, n := range m.GetRadioConfig().GetPreferences().GetIgnoreIncoming() {
+		if n == num {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredPacket drops packets from ignored nodes that were already queued when the node was ignored
+func (m *Mesh) ignoredPacket(pkt *message.MeshPacket) bool {
+	if !m.isIgnored(pkt.GetFrom()) {
+		return false
+	}
+	m.logger.WithField(mt.FIELD_NODE, pkt.GetFrom()).Debug("dropping packet from ignored node")
+	return true
+}
@@ -2,7 +2,11 @@ package mesh
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,11 +25,32 @@ const (
 
 	TOPIC_DATA Topic = iota
 	TOPIC_NODE
+	TOPIC_STATE          // types.ConnState
+	TOPIC_DEBUG          // string, a line of firmware debug output
+	TOPIC_REBOOTED       // time.Time the radio reported a reboot, cached state was dropped
+	TOPIC_FIRMWARE_ERROR // *FirmwareError, each time MyNodeInfo.ErrorCount goes up
+	TOPIC_ROUTE          // *Route, from each RouteReply
+	TOPIC_RECEIPT        // *Receipt, when a packet we sent is acked, read or failed
 
 	RX_CHAN_SIZE = 10
+
+	// How long Connect waits for the radio to send its config
+	CONFIG_TIMEOUT = 10 * time.Second
+
+	// Used until MyNodeInfo.MessageTimeoutMsec is known
+	MESSAGE_TIMEOUT = 5 * time.Minute
+
+	// Pass as the device to NewMesh to use the first radio found by Discover
+	DEVICE_AUTO = "auto"
+
+	// NODENUM_BROADCAST in the device code
+	BROADCAST_ADDR = 0xffffffff
 )
 
-var TOPICS = []Topic{TOPIC_DATA, TOPIC_NODE}
+var TOPICS = []Topic{TOPIC_DATA, TOPIC_NODE, TOPIC_STATE, TOPIC_DEBUG, TOPIC_REBOOTED, TOPIC_FIRMWARE_ERROR, TOPIC_ROUTE, TOPIC_RECEIPT}
+
+// ErrConfigTimeout is returned when the radio does not finish sending its config in time
+var ErrConfigTimeout = errors.New("timed out waiting for radio config")
 
 type Transport int
 type Topic int
@@ -34,28 +59,170 @@ type Mesh struct {
 	transport   mt.TransportInterface
 	mu          *sync.Mutex
 	rxChan      chan []byte
+	stateMu     sync.RWMutex // guards radioConfig and myInfo, the receive goroutine replaces them
 	radioConfig *message.RadioConfig
 	myInfo      *message.MyNodeInfo
 	stopped     uint32
+	done        chan struct{} // closed by Close, stops the receive and clock sync goroutines
 	topic       map[Topic][]func(interface{})
+	posMu       sync.Mutex
+	position    *message.Position // last position sent with SendPosition
+	stats       mt.StatsInterface
+	packetID    uint32
+	acks        *ackTracker
+	logger      log.FieldLogger
+	cfgMu       sync.Mutex
+	configID    uint32
+	configDone  chan struct{} // closed when ConfigCompleteId for configID arrives
+	serialOpts  serial.Options
+	debugOut    io.Writer
+	debugMu     sync.Mutex
+	wrap        func(mt.TransportFactory) mt.TransportFactory
+	nodeMu      sync.Mutex
+	nodes       map[uint32]*message.NodeInfo // from NodeInfo, cleared on reboot
+	health      healthTracker
+	compatMode  CompatMode
+	compat      uint32 // 1 when the firmware did not pass negotiate, see COMPAT_DOWNGRADE
+	renegotiate uint32 // 1 from a reboot until the config requested after it completes
+	cfgTimeout  time.Duration
+	routes      routeWaiters
+	dedup       dedupCache
+	dedupWindow time.Duration
+	prefsMu     sync.Mutex // serializes writes of the radio config, so read-modify-write sees the last one
+}
+
+// Option configures a Mesh
+type Option func(*Mesh)
+
+// WithLogger sends mesh and transport logs to l instead of the logrus standard logger
+func WithLogger(l log.FieldLogger) Option {
+	return func(m *Mesh) {
+		m.logger = l
+	}
+}
+
+// WithStats reports mesh and transport counters to st, see pkg/metrics
+func WithStats(st mt.StatsInterface) Option {
+	return func(m *Mesh) {
+		m.stats = st
+	}
+}
+
+// WithSerialOptions sets the baud rate, wake and pacing behavior of TRANSPORT_SERIAL
+func WithSerialOptions(o serial.Options) Option {
+	return func(m *Mesh) {
+		m.serialOpts = o
+	}
+}
+
+// WithDebugWriter copies the firmware debug output to w, one line at a time.
+// The lines are also published on TOPIC_DEBUG.
+func WithDebugWriter(w io.Writer) Option {
+	return func(m *Mesh) {
+		m.debugOut = w
+	}
+}
+
+// WithTransportWrapper wraps the transport created by NewMesh, e.g. with capture.Wrap to record a session
+func WithTransportWrapper(wrap func(mt.TransportFactory) mt.TransportFactory) Option {
+	return func(m *Mesh) {
+		m.wrap = wrap
+	}
+}
+
+// WithCompatMode sets what Connect does with incompatible firmware, the default is COMPAT_STRICT
+func WithCompatMode(mode CompatMode) Option {
+	return func(m *Mesh) {
+		m.compatMode = mode
+	}
 }
 
-func NewMesh(dev string, tr Transport) (*Mesh, error) {
+// WithDedupWindow sets how long received packets are remembered to drop copies, the default
+// is DEDUP_WINDOW. 0 hands every copy to subscribers.
+func WithDedupWindow(d time.Duration) Option {
+	return func(m *Mesh) {
+		m.dedupWindow = d
+	}
+}
+
+// WithConfigTimeout sets how long Connect waits for the radio config, the default is CONFIG_TIMEOUT
+func WithConfigTimeout(d time.Duration) Option {
+	return func(m *Mesh) {
+		m.cfgTimeout = d
+	}
+}
+
+// newMesh applies opts, also returns the logger for the transport
+func newMesh(opts ...Option) (*Mesh, log.FieldLogger) {
 	m := &Mesh{
 		mu:     &sync.Mutex{},
 		rxChan: make(chan []byte, RX_CHAN_SIZE),
+		done:   make(chan struct{}),
+		stats:  mt.NopStats{},
+		acks:   newAckTracker(),
+		logger: log.StandardLogger(),
+		nodes:  make(map[uint32]*message.NodeInfo),
+
+		cfgTimeout:  CONFIG_TIMEOUT,
+		dedupWindow: DEDUP_WINDOW,
+
+		serialOpts: serial.DefaultOptions(),
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	trLogger := m.logger
+	m.logger = m.logger.WithField(mt.FIELD_COMPONENT, "mesh")
 	// Create topics
 	m.topic = make(map[Topic][]func(interface{}))
 	for _, tp := range TOPICS {
 		m.topic[tp] = make([]func(interface{}), 0)
 	}
+	if m.debugOut != nil {
+		m.Subscribe(TOPIC_DEBUG, m.writeDebug)
+	}
+	return m, trLogger
+}
+
+// NewMeshWithTransport uses the transport made by tf, e.g. a capture.NewReplay
+func NewMeshWithTransport(tf mt.TransportFactory, opts ...Option) *Mesh {
+	m, _ := newMesh(opts...)
+	m.setTransport(tf)
+	return m
+}
+
+func (m *Mesh) setTransport(tf mt.TransportFactory) {
+	if m.wrap != nil {
+		tf = m.wrap(tf)
+	}
+	m.transport = tf(m.rxChan, m.mu)
+}
 
+func NewMesh(dev string, tr Transport, opts ...Option) (*Mesh, error) {
+	m, trLogger := newMesh(opts...)
 	switch tr {
 	case TRANSPORT_BLUETOOTH:
 		return nil, errors.New("bluetooth not implemented")
 	case TRANSPORT_SERIAL:
-		m.transport = serial.NewSerialPort(dev, m.rxChan, m.mu)
+		if dev == DEVICE_AUTO {
+			devs, err := Discover(opts...)
+			if err != nil {
+				return nil, err
+			}
+			if len(devs) == 0 {
+				return nil, errors.New("no radio found")
+			}
+			dev = devs[0].Path
+		}
+		m.setTransport(func(rxCh chan []byte, mu *sync.Mutex) mt.TransportInterface {
+			return serial.NewSerialPort(dev, rxCh, mu,
+				serial.WithLogger(trLogger),
+				serial.WithStats(m.stats),
+				serial.WithStateHandler(m.handleState),
+				serial.WithOptions(m.serialOpts),
+				serial.WithDebugHandler(m.handleDebug),
+			)
+		})
 	default:
 		return nil, errors.New("invalid transport")
 	}
@@ -66,63 +233,364 @@ func (m *Mesh) Connect() error {
 	// Connect to transport
 	err := m.transport.Connect()
 	if err != nil {
-		log.WithError(err).Error("could not connect to transport")
+		m.logger.WithError(err).Error("could not connect to transport")
 		return err
 	}
+	m.health.setState(mt.STATE_CONNECTED)
+	m.pub(TOPIC_STATE, mt.STATE_CONNECTED)
 	go m.transport.Listen()
 	go m.receiveFromRadio()
 
 	// Get radio config
 	err = m.getRadioConfig()
 	if err != nil {
-		log.WithError(err).Error("could not connect to transport")
+		m.logger.WithError(err).Error("could not request radio config")
+		m.Close()
+		return err
+	}
+	err = m.WaitForConfig(m.cfgTimeout)
+	if err != nil {
+		m.logger.WithError(err).Error("radio did not send its config")
+		m.Close()
+		return err
+	}
+	err = m.negotiate()
+	if err != nil {
+		m.Close()
 		return err
 	}
-
 	return nil
 }
 
 func (m *Mesh) Close() {
-	log.Debug("closing connection")
-	atomic.SwapUint32(&m.stopped, 0)
+	m.logger.Debug("closing connection")
+	m.stop()
 	m.transport.Close()
+	m.health.setState(mt.STATE_DISCONNECTED)
+}
+
+// stop ends the receive and clock sync goroutines
+func (m *Mesh) stop() {
+	if atomic.CompareAndSwapUint32(&m.stopped, 0, 1) {
+		close(m.done)
+	}
 }
 
 func (m *Mesh) GetMyNodeInfo() *message.MyNodeInfo {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
 	return m.myInfo
 }
 
 func (m *Mesh) GetRadioConfig() *message.RadioConfig {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
 	return m.radioConfig
 }
 
+func (m *Mesh) setMyNodeInfo(info *message.MyNodeInfo) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.myInfo = info
+}
+
+func (m *Mesh) setCachedRadioConfig(cfg *message.RadioConfig) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.radioConfig = cfg
+}
+
+// GetNodes returns the nodes the radio told us about, ordered by node number.
+// Ignored nodes are left out, see IgnoreNode.
+func (m *Mesh) GetNodes() []*message.NodeInfo {
+	return m.nodeList(true)
+}
+
+func (m *Mesh) nodeList(hideIgnored bool) []*message.NodeInfo {
+	m.nodeMu.Lock()
+	defer m.nodeMu.Unlock()
+	nodes := make([]*message.NodeInfo, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		if !hideIgnored || !m.isIgnored(n.GetNum()) {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].GetNum() < nodes[j].GetNum() })
+	return nodes
+}
+
+// SetRadioConfig writes cfg to the radio. GetRadioConfig returns it from then on,
+// until the radio sends its config again.
 func (m *Mesh) SetRadioConfig(cfg *message.RadioConfig) error {
+	m.prefsMu.Lock()
+	defer m.prefsMu.Unlock()
+	return m.setRadioConfig(cfg)
+}
+
+// setRadioConfig is SetRadioConfig for callers holding prefsMu
+func (m *Mesh) setRadioConfig(cfg *message.RadioConfig) error {
+	if m.Compat() {
+		return ErrCompatMode
+	}
 	msg := &message.ToRadio{
 		Variant: &message.ToRadio_SetRadio{
 			SetRadio: cfg,
 		},
 	}
-	return m.sendToRadio(msg)
+	err := m.sendToRadio(msg)
+	if err != nil {
+		return err
+	}
+	m.setCachedRadioConfig(proto.Clone(cfg).(*message.RadioConfig))
+	return nil
+}
+
+// handleDebug publishes a line of firmware console output or a DebugString from the radio
+func (m *Mesh) handleDebug(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return
+	}
+	m.pub(TOPIC_DEBUG, line)
+}
+
+// writeDebug is the TOPIC_DEBUG subscriber for WithDebugWriter.
+// Console lines and DebugString arrive on different goroutines.
+func (m *Mesh) writeDebug(msg interface{}) {
+	m.debugMu.Lock()
+	defer m.debugMu.Unlock()
+	_, err := fmt.Fprintln(m.debugOut, msg)
+	if err != nil {
+		m.logger.WithError(err).Debug("could not write debug output")
+	}
+}
+
+// handleRebooted drops everything learned from the radio before it rebooted and asks for it again
+func (m *Mesh) handleRebooted() {
+	m.logger.Warn("radio rebooted, requesting config again")
+	m.stateMu.Lock()
+	m.myInfo = nil
+	m.radioConfig = nil
+	m.stateMu.Unlock()
+	m.nodeMu.Lock()
+	m.nodes = make(map[uint32]*message.NodeInfo)
+	m.nodeMu.Unlock()
+	m.pub(TOPIC_REBOOTED, time.Now())
+
+	// The radio may come back with other firmware, check it once the config is in
+	atomic.StoreUint32(&m.renegotiate, 1)
+	err := m.getRadioConfig()
+	if err != nil {
+		m.logger.WithError(err).Error("could not request radio config after reboot")
+	}
+}
+
+// handleState is called by the transport when the connection drops and comes back
+func (m *Mesh) handleState(st mt.ConnState) {
+	m.health.setState(st)
+	m.pub(TOPIC_STATE, st)
+	if st != mt.STATE_CONNECTED {
+		return
+	}
+	// The radio may have rebooted while we were gone, sync up again
+	err := m.getRadioConfig()
+	if err != nil {
+		m.logger.WithError(err).Error("could not request radio config after reconnect")
+	}
+}
+
+// SendPosition broadcasts our position for radios without a GPS (MyNodeInfo.HasGps == false).
+// lat and lon are in degrees, alt in meters and battery 1-100 (0 means not provided).
+// The host time is included so the radio can also set its RTC.
+func (m *Mesh) SendPosition(lat, lon float64, alt, battery int32) error {
+	if m.GetMyNodeInfo().GetHasGps() {
+		return errors.New("radio has a gps, not overriding its position")
+	}
+	pos, err := newPosition(lat, lon, alt, battery)
+	if err != nil {
+		return err
+	}
+	// sendPosition sets Time, keep a copy SyncClock can clone while it does
+	m.posMu.Lock()
+	m.position = proto.Clone(pos).(*message.Position)
+	m.posMu.Unlock()
+	return m.sendPosition(pos)
+}
+
+// SyncClock pushes the host wall clock to the radio every interval until Close.
+// The last position given to SendPosition is resent with it, otherwise the
+// position carries no coordinates and only sets the radio RTC.
+func (m *Mesh) SyncClock(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid clock sync interval %s", interval)
+	}
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for atomic.LoadUint32(&m.stopped) == 0 {
+			pos := &message.Position{}
+			m.posMu.Lock()
+			if m.position != nil {
+				pos = proto.Clone(m.position).(*message.Position)
+			}
+			m.posMu.Unlock()
+			err := m.sendPosition(pos)
+			if err != nil {
+				m.logger.WithError(err).Error("could not sync clock")
+			}
+			select {
+			case <-tick.C:
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *Mesh) sendPosition(pos *message.Position) error {
+	pos.Time = uint32(time.Now().Unix())
+	m.logger.WithField(mt.FIELD_POSITION, pos).Debug("sending position")
+	sub := &message.SubPacket{
+		Payload: &message.SubPacket_Position{
+			Position: pos,
+		},
+	}
+	_, err := m.sendPacket(BROADCAST_ADDR, sub, false)
+	return err
 }
 
 // Sends a WantConfigId msg to transport
 func (m *Mesh) getRadioConfig() error {
 	rand.Seed(time.Now().UnixNano())
 	rn := rand.Uint32()
+	m.cfgMu.Lock()
+	m.configID = rn
+	// An unfinished request is replaced, e.g. after a reboot, its waiters get this answer
+	select {
+	case <-m.configDone:
+		m.configDone = make(chan struct{})
+	default:
+		if m.configDone == nil {
+			m.configDone = make(chan struct{})
+		}
+	}
+	m.cfgMu.Unlock()
 	msg := &message.ToRadio{
 		Variant: &message.ToRadio_WantConfigId{
 			WantConfigId: rn,
 		},
 	}
-	log.WithField("config_id", rn).Debug("sending WantConfig to radio")
+	m.logger.WithField(mt.FIELD_CONFIG_ID, rn).Debug("sending WantConfig to radio")
 	return m.sendToRadio(msg)
 }
 
+// wrap sub in a MeshPacket and send it, the radio fills in From. Returns the packet id.
+func (m *Mesh) sendPacket(to uint32, sub *message.SubPacket, wantAck bool) (uint32, error) {
+	id := m.nextPacketID()
+	err := m.sendPacketWithID(id, to, sub, wantAck)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// sendPacketWithID is sendPacket for callers that need the id before the packet goes out
+func (m *Mesh) sendPacketWithID(id, to uint32, sub *message.SubPacket, wantAck bool) error {
+	msg := &message.ToRadio{
+		Variant: &message.ToRadio_Packet{
+			Packet: &message.MeshPacket{
+				To:      to,
+				Id:      id,
+				WantAck: wantAck,
+				Payload: &message.MeshPacket_Decoded{
+					Decoded: sub,
+				},
+			},
+		},
+	}
+	err := m.sendToRadio(msg)
+	if err != nil {
+		return err
+	}
+	if wantAck {
+		m.acks.sent(id, m.messageTimeout())
+	}
+	return nil
+}
+
+// nextPacketID picks ids from the opposite side of the packet id space
+// to the radio, see MyNodeInfo.CurrentPacketId
+func (m *Mesh) nextPacketID() uint32 {
+	info := m.GetMyNodeInfo()
+	bits, cur := uint64(8), uint64(info.GetCurrentPacketId())
+	if info.GetPacketIdBits() != 0 {
+		bits = uint64(info.GetPacketIdBits())
+	}
+	mask := uint64(1)<<bits - 1
+	for {
+		id := (cur + mask/2 + uint64(atomic.AddUint32(&m.packetID, 1))) & mask
+		if id != 0 {
+			return uint32(id)
+		}
+	}
+}
+
+// messageTimeout is how long the mesh may take to deliver a packet
+func (m *Mesh) messageTimeout() time.Duration {
+	if ms := m.GetMyNodeInfo().GetMessageTimeoutMsec(); ms != 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return MESSAGE_TIMEOUT
+}
+
+// RequestConfig asks the radio for its config again and waits for it, e.g. to check a SetRadioConfig
+func (m *Mesh) RequestConfig(timeout time.Duration) error {
+	err := m.getRadioConfig()
+	if err != nil {
+		return err
+	}
+	return m.WaitForConfig(timeout)
+}
+
+// WaitForConfig blocks until the radio has sent its node info, config and
+// node list in response to the last config request, e.g. the one from Connect.
+func (m *Mesh) WaitForConfig(timeout time.Duration) error {
+	m.cfgMu.Lock()
+	done := m.configDone
+	m.cfgMu.Unlock()
+	if done == nil {
+		return errors.New("radio config was not requested")
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrConfigTimeout
+	}
+}
+
+// configComplete returns false for ids of earlier requests
+func (m *Mesh) configComplete(id uint32) bool {
+	m.cfgMu.Lock()
+	defer m.cfgMu.Unlock()
+	if id != m.configID || m.configDone == nil {
+		m.logger.WithField(mt.FIELD_CONFIG_ID, id).Debug("ignoring stale config complete")
+		return false
+	}
+	select {
+	case <-m.configDone:
+	default:
+		close(m.configDone)
+	}
+	return true
+}
+
 // send message to radio, return is handled async
 func (m *Mesh) sendToRadio(msg *message.ToRadio) error {
 	data, err := proto.Marshal(msg)
 	if err != nil {
-		log.WithError(err).Error("failure marshalling ToRadio proto")
+		m.logger.WithError(err).Error("failure marshalling ToRadio proto")
 		return errors.New("could not get radio config")
 	}
 
@@ -134,45 +602,103 @@ func (m *Mesh) sendToRadio(msg *message.ToRadio) error {
 }
 
 func (m *Mesh) receiveFromRadio() {
-	for m.stopped == 0 {
-		data := <-m.rxChan
-		log.Debug("received message from radio")
+	for atomic.LoadUint32(&m.stopped) == 0 {
+		var data []byte
+		select {
+		case data = <-m.rxChan:
+		case <-m.done:
+			return
+		}
+		m.logger.Debug("received message from radio")
 
 		var msg message.FromRadio
 		err := proto.Unmarshal(data, &msg)
 		if err != nil {
-			log.WithError(err).Error("Could not marshall proto")
+			m.logger.WithError(err).Error("could not unmarshal FromRadio proto")
+			m.stats.UnmarshalFailed()
+			continue
 		}
-		log.Debug("proto message parsed")
+		m.logger.Debug("proto message parsed")
 
 		switch msg.Variant.(type) {
 		case *message.FromRadio_MyInfo:
-			log.WithField("my_node", msg.GetMyInfo()).Debug("got my node info")
-			m.myInfo = msg.GetMyInfo()
+			m.logger.WithField(mt.FIELD_MY_NODE, msg.GetMyInfo()).Debug("got my node info")
+			m.setMyNodeInfo(msg.GetMyInfo())
+			m.checkFirmwareError(msg.GetMyInfo())
 		case *message.FromRadio_Radio:
-			log.WithField("radio", msg.GetRadio()).Debug("got radio config")
-			m.radioConfig = msg.GetRadio()
+			m.logger.WithField(mt.FIELD_RADIO, msg.GetRadio()).Debug("got radio config")
+			m.setCachedRadioConfig(msg.GetRadio())
 		case *message.FromRadio_NodeInfo:
-			log.WithField("node", msg.GetNodeInfo()).Debug("got node info")
-			m.pub(TOPIC_NODE, msg.GetNodeInfo())
+			m.logger.WithField(mt.FIELD_NODE, msg.GetNodeInfo()).Debug("got node info")
+			m.stats.NodeUpdated(msg.GetNodeInfo())
+			m.nodeMu.Lock()
+			m.nodes[msg.GetNodeInfo().GetNum()] = msg.GetNodeInfo()
+			m.nodeMu.Unlock()
+			if !m.isIgnored(msg.GetNodeInfo().GetNum()) {
+				m.pub(TOPIC_NODE, msg.GetNodeInfo())
+			}
+		case *message.FromRadio_Packet:
+			m.logger.WithField(mt.FIELD_PACKET, msg.GetPacket()).Debug("got mesh packet")
+			m.handlePacket(msg.GetPacket())
+		case *message.FromRadio_DebugString:
+			m.handleDebug(msg.GetDebugString().GetMessage())
+		case *message.FromRadio_Rebooted:
+			m.handleRebooted()
 		case *message.FromRadio_ConfigCompleteId:
-			// TODO: implement this
-			log.WithField("node", msg.GetConfigCompleteId()).Debug("got config complete")
+			m.logger.WithField(mt.FIELD_CONFIG_ID, msg.GetConfigCompleteId()).Debug("got config complete")
+			if m.configComplete(msg.GetConfigCompleteId()) && atomic.CompareAndSwapUint32(&m.renegotiate, 1, 0) {
+				m.negotiateAfterReboot()
+			}
 		default:
-			log.WithField("fromRadio", msg.GetVariant()).Error("unsupported message type")
+			m.logger.WithField(mt.FIELD_VARIANT, msg.GetVariant()).Error("unsupported message type")
+			m.stats.UnsupportedVariant(fmt.Sprintf("%T", msg.GetVariant()))
 		}
 	}
 }
 
+func (m *Mesh) handlePacket(pkt *message.MeshPacket) {
+	if m.isDuplicate(pkt) {
+		m.logger.WithField(mt.FIELD_NODE, pkt.GetFrom()).WithField(mt.FIELD_PACKET_ID, pkt.GetId()).Debug("dropping duplicate packet")
+		return
+	}
+	if m.ignoredPacket(pkt) {
+		return
+	}
+	m.stats.PacketReceived(pkt)
+	sub := pkt.GetDecoded()
+	if id := sub.GetSuccessId(); id != 0 {
+		if latency, ok := m.acks.acked(id); ok {
+			m.logger.WithField(mt.FIELD_PACKET_ID, id).WithField(mt.FIELD_LATENCY, latency).Debug("got ack")
+			m.stats.AckReceived(pkt.From, latency)
+			m.receipt(id, pkt.From, RECEIPT_DELIVERED)
+		}
+	}
+	if id := sub.GetFailId(); id != 0 {
+		m.logger.WithField(mt.FIELD_PACKET_ID, id).Debug("got nak")
+		if _, ok := m.acks.acked(id); ok {
+			m.receipt(id, pkt.From, RECEIPT_FAILED)
+		}
+	}
+	switch sub.GetPayload().(type) {
+	case *message.SubPacket_RouteReply:
+		m.handleRouteReply(pkt)
+	case *message.SubPacket_RouteError:
+		m.handleRouteError(pkt)
+	case *message.SubPacket_Data:
+		if sub.GetData().GetTyp() == message.Data_CLEAR_READACK {
+			m.handleReadAck(pkt)
+		}
+	}
+	m.pub(TOPIC_DATA, pkt)
+}
+
 // The pub/sub model will most likely go away after BLE is implemented.
 func (m *Mesh) Subscribe(tp Topic, fn func(interface{})) {
-	switch tp {
-	case TOPIC_NODE:
-		m.topic[tp] = append(m.topic[tp], fn)
-	case TOPIC_DATA:
-	default:
-		log.WithField("topic", tp).Error("invalid topic")
+	if _, ok := m.topic[tp]; !ok {
+		m.logger.WithField(mt.FIELD_TOPIC, tp).Error("invalid topic")
+		return
 	}
+	m.topic[tp] = append(m.topic[tp], fn)
 }
 
 func (m *Mesh) pub(tp Topic, pkt interface{}) {
@@ -1,13 +1,22 @@
 package mesh
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	"github.com/nerdoftech/Meshtastic-go/pkg/serial"
 	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
 	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"google.golang.org/protobuf/proto"
 
 	. "github.com/onsi/ginkgo"
@@ -15,19 +24,38 @@ import (
 )
 
 func TestMesh(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Mesh Suite")
 }
 
+var logger = func() *log.Logger {
+	l := log.New()
+	l.SetLevel(log.DebugLevel)
+	return l
+}()
+
 func fromRadio(pb *message.FromRadio) []byte {
 	data, err := proto.Marshal(pb)
 	if err != nil {
-		log.WithError(err).Fatal("error creating pb")
+		logger.WithError(err).Fatal("error creating pb")
 	}
 	return data
 }
 
+// toRadio decodes what the mesh sent to the mock transport
+func toRadio(data []byte) *message.ToRadio {
+	msg := &message.ToRadio{}
+	Expect(proto.Unmarshal(data, msg)).Should(Succeed())
+	return msg
+}
+
+// capturePacket returns a SendToRadio Do func that keeps the MeshPacket sent in *sent
+func capturePacket(sent **message.MeshPacket) func([]byte) {
+	return func(data []byte) {
+		*sent = toRadio(data).GetPacket()
+	}
+}
+
 var _ = Describe("Mesh", func() {
 	var mockTransport *mt.MockTransportInterface
 	var mesh *Mesh
@@ -35,37 +63,261 @@ var _ = Describe("Mesh", func() {
 		crtl := gomock.NewController(GinkgoT())
 		mockTransport = mt.NewMockTransportInterface(crtl)
 		mesh = &Mesh{
-			transport: mockTransport,
-			rxChan:    make(chan []byte, 1),
+			transport:  mockTransport,
+			rxChan:     make(chan []byte, 1),
+			done:       make(chan struct{}),
+			stats:      mt.NopStats{},
+			acks:       newAckTracker(),
+			logger:     logger,
+			nodes:      make(map[uint32]*message.NodeInfo),
+			cfgTimeout: time.Second,
 		}
 		mesh.topic = make(map[Topic][]func(interface{}))
 		for _, tp := range TOPICS {
 			mesh.topic[tp] = make([]func(interface{}), 0)
 		}
 	})
+	AfterEach(func() {
+		mesh.stop()
+	})
 	Context("Connect", func() {
+		// answerConfig makes the mock radio answer WantConfigId with info
+		answerConfig := func(info *message.MyNodeInfo) func([]byte) {
+			return func(b []byte) {
+				req := toRadio(b)
+				go func() {
+					mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_MyInfo{MyInfo: info}})
+					mesh.rxChan <- fromRadio(&message.FromRadio{
+						Variant: &message.FromRadio_ConfigCompleteId{ConfigCompleteId: req.GetWantConfigId()},
+					})
+				}()
+			}
+		}
+		BeforeEach(func() {
+			mockTransport.EXPECT().Connect().Return(nil).AnyTimes()
+			mockTransport.EXPECT().Listen().AnyTimes()
+			mockTransport.EXPECT().Close().AnyTimes()
+		})
+		AfterEach(func() {
+			mesh.Close() // Stop goroutines
+		})
 		It("should work", func() {
-			mockTransport.EXPECT().Connect().Return(nil)
-			mockTransport.EXPECT().Listen()
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).
+				Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "0.9.1", MinAppVersion: APP_VERSION})).
+				Return(nil)
+			err := mesh.Connect()
+			Expect(err).Should(BeNil())
+			Expect(mesh.Compat()).Should(BeFalse())
+		})
+		It("should time out without config", func() {
+			mesh.cfgTimeout = 10 * time.Millisecond
 			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil)
-			mockTransport.EXPECT().Close()
+			Expect(mesh.Connect()).Should(Equal(ErrConfigTimeout))
+			Expect(mesh.done).Should(BeClosed())
+		})
+		It("should refuse incompatible firmware", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).
+				Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "1.0.0", MinAppVersion: APP_VERSION + 1})).
+				Return(nil)
+			err := mesh.Connect()
+			Expect(errors.Is(err, ErrIncompatibleFirmware)).Should(BeTrue())
+			Expect(err.(*FirmwareVersionError).MinAppVersion).Should(Equal(uint32(APP_VERSION + 1)))
+			Expect(mesh.done).Should(BeClosed())
+		})
+		It("should downgrade to compatibility mode", func() {
+			mesh.compatMode = COMPAT_DOWNGRADE
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).
+				Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "0.7.5"})).
+				Return(nil)
+			Expect(mesh.Connect()).Should(Succeed())
+			Expect(mesh.Compat()).Should(BeTrue())
+			Expect(mesh.SetRadioConfig(&message.RadioConfig{})).Should(Equal(ErrCompatMode))
+		})
+		It("should finish when the radio reboots during the handshake", func() {
+			gomock.InOrder(
+				mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(func([]byte) {
+					go func() {
+						mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_Rebooted{Rebooted: true}})
+					}()
+				}).Return(nil),
+				mockTransport.EXPECT().SendToRadio(gomock.Any()).
+					Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "0.9.1"})).Return(nil),
+			)
+			Expect(mesh.Connect()).Should(Succeed())
+			Expect(mesh.GetMyNodeInfo().GetFirmwareVersion()).Should(Equal("0.9.1"))
+		})
+		It("should check the firmware again after a reboot", func() {
+			mesh.compatMode = COMPAT_DOWNGRADE
+			gomock.InOrder(
+				mockTransport.EXPECT().SendToRadio(gomock.Any()).
+					Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "0.9.1"})).Return(nil),
+				mockTransport.EXPECT().SendToRadio(gomock.Any()).
+					Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "0.7.5"})).Return(nil),
+				mockTransport.EXPECT().SendToRadio(gomock.Any()).
+					Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "0.9.2"})).Return(nil),
+			)
+			Expect(mesh.Connect()).Should(Succeed())
+			Expect(mesh.Compat()).Should(BeFalse())
+			mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_Rebooted{Rebooted: true}})
+			Eventually(mesh.Compat).Should(BeTrue())
+			mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_Rebooted{Rebooted: true}})
+			Eventually(mesh.Compat).Should(BeFalse())
+		})
+		It("should close when the firmware is incompatible after a reboot", func() {
+			gomock.InOrder(
+				mockTransport.EXPECT().SendToRadio(gomock.Any()).
+					Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "0.9.1"})).Return(nil),
+				mockTransport.EXPECT().SendToRadio(gomock.Any()).
+					Do(answerConfig(&message.MyNodeInfo{FirmwareVersion: "0.9.1", MinAppVersion: APP_VERSION + 1})).Return(nil),
+			)
+			Expect(mesh.Connect()).Should(Succeed())
+			mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_Rebooted{Rebooted: true}})
+			Eventually(mesh.done).Should(BeClosed())
+		})
+		It("should error getRadioConfig", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(errors.New("error"))
 			err := mesh.Connect()
+			Expect(err).Should(HaveOccurred())
+		})
+		It("should parse versions", func() {
+			v, err := ParseVersion("v0.9.1-a1b2c3")
 			Expect(err).Should(BeNil())
-			mesh.Close() // Stop goroutines
+			Expect(v).Should(Equal(Version{0, 9, 1}))
+			Expect(v.Less(Version{0, 10, 0})).Should(BeTrue())
+			Expect(Version{1, 0, 0}.Less(v)).Should(BeFalse())
+			_, err = ParseVersion("0.9")
+			Expect(err).Should(HaveOccurred())
+			Expect(checkFirmware("", 0)).Should(HaveOccurred())
 		})
+	})
+	Context("Connect errors", func() {
 		It("should error Connect", func() {
 			mockTransport.EXPECT().Connect().Return(errors.New("error"))
 			err := mesh.Connect()
 			Expect(err).Should(HaveOccurred())
 		})
-		It("should error getRadioConfig", func() {
-			mockTransport.EXPECT().Connect().Return(nil)
-			mockTransport.EXPECT().Listen()
-			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(errors.New("error"))
-			mockTransport.EXPECT().Close()
-			err := mesh.Connect()
+	})
+	Context("NewMesh", func() {
+		It("should use the given logger", func() {
+			l, hook := test.NewNullLogger()
+			l.SetLevel(log.DebugLevel)
+			m, err := NewMesh("/dev/null", TRANSPORT_SERIAL, WithLogger(l))
+			Expect(err).Should(BeNil())
+			m.Subscribe(Topic(99), func(interface{}) {})
+			Expect(hook.LastEntry().Data).Should(HaveKeyWithValue(mt.FIELD_COMPONENT, "mesh"))
+			Expect(hook.LastEntry().Data).Should(HaveKeyWithValue(mt.FIELD_TOPIC, Topic(99)))
+		})
+		It("should error on bad transport", func() {
+			_, err := NewMesh("/dev/null", TRANSPORT_BLUETOOTH)
 			Expect(err).Should(HaveOccurred())
-			mesh.Close() // Stop goroutines
+			_, err = NewMesh("/dev/null", Transport(99))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Context("WaitForConfig", func() {
+		It("should wait for the matching config complete", func() {
+			go mesh.receiveFromRadio()
+			Expect(mesh.WaitForConfig(time.Millisecond)).ShouldNot(Succeed())
+
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil)
+			Expect(mesh.getRadioConfig()).Should(Succeed())
+			Expect(mesh.WaitForConfig(time.Millisecond)).Should(Equal(ErrConfigTimeout))
+
+			// stale id from an earlier request
+			mesh.rxChan <- fromRadio(&message.FromRadio{
+				Variant: &message.FromRadio_ConfigCompleteId{ConfigCompleteId: mesh.configID + 1},
+			})
+			Expect(mesh.WaitForConfig(10 * time.Millisecond)).Should(Equal(ErrConfigTimeout))
+
+			mesh.rxChan <- fromRadio(&message.FromRadio{
+				Variant: &message.FromRadio_ConfigCompleteId{ConfigCompleteId: mesh.configID},
+			})
+			Expect(mesh.WaitForConfig(time.Second)).Should(Succeed())
+			Expect(mesh.WaitForConfig(time.Millisecond)).Should(Succeed())
+		})
+	})
+	Context("discover", func() {
+		var root string
+		BeforeEach(func() {
+			var err error
+			root, err = ioutil.TempDir("", "sysfs")
+			Expect(err).Should(BeNil())
+			for i, id := range [][]string{{"10c4", "ea60"}, {"1a86", "7523"}} {
+				name := fmt.Sprintf("ttyUSB%d", i)
+				dev := filepath.Join(root, "sys/devices/usb1", name)
+				Expect(os.MkdirAll(filepath.Join(dev, "1-1:1.0", name), 0755)).Should(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(dev, "idVendor"), []byte(id[0]), 0644)).Should(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(dev, "idProduct"), []byte(id[1]), 0644)).Should(Succeed())
+				class := filepath.Join(root, serial.SYSFS_TTY, name)
+				Expect(os.MkdirAll(class, 0755)).Should(Succeed())
+				Expect(os.Symlink(filepath.Join(dev, "1-1:1.0", name), filepath.Join(class, "device"))).Should(Succeed())
+			}
+		})
+		AfterEach(func() {
+			os.RemoveAll(root)
+			probeDevice = probe
+		})
+		It("should return candidates that answer", func() {
+			probeDevice = func(path string, opts ...Option) (*Device, error) {
+				if filepath.Base(path) == "ttyUSB0" {
+					return nil, ErrConfigTimeout
+				}
+				return &Device{Path: path, HwModel: "TBEAM", FirmwareVersion: "0.9.1"}, nil
+			}
+			devs, err := discover(root)
+			Expect(err).Should(BeNil())
+			Expect(devs).Should(Equal([]Device{{
+				Path:            filepath.Join(root, "dev/ttyUSB1"),
+				Bridge:          "CH340",
+				HwModel:         "TBEAM",
+				FirmwareVersion: "0.9.1",
+			}}))
+		})
+		It("should skip ports that fail to open", func() {
+			devs, err := discover(root, WithLogger(logger))
+			Expect(err).Should(BeNil())
+			Expect(devs).Should(BeEmpty())
+		})
+	})
+	Context("backup", func() {
+		var dir string
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "backup")
+			Expect(err).Should(BeNil())
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		It("should need the radio config", func() {
+			_, err := mesh.Backup()
+			Expect(err).Should(Equal(ErrNoConfig))
+			Expect(mesh.Restore(&message.DeviceState{})).Should(Equal(ErrNoConfig))
+		})
+		It("should back up and restore", func() {
+			mesh.myInfo = &message.MyNodeInfo{MyNodeNum: 7}
+			mesh.radioConfig = &message.RadioConfig{ChannelSettings: &message.ChannelSettings{Name: "ops", Psk: []byte{1, 2}}}
+			mesh.nodes[7] = &message.NodeInfo{Num: 7, User: &message.User{Id: "!old", LongName: "Base", ShortName: "B", Macaddr: []byte{1}}}
+			mesh.nodes[8] = &message.NodeInfo{Num: 8}
+
+			path := filepath.Join(dir, "radio.backup")
+			Expect(mesh.BackupToFile(path)).Should(Succeed())
+			st, err := os.Stat(path)
+			Expect(err).Should(BeNil())
+			Expect(st.Mode().Perm()).Should(Equal(os.FileMode(BACKUP_FILE_MODE)))
+
+			ds, err := LoadBackup(path)
+			Expect(err).Should(BeNil())
+			Expect(ds.NodeDb).Should(HaveLen(2))
+			Expect(ds.Owner.LongName).Should(Equal("Base"))
+
+			sent := make([]*message.ToRadio, 0)
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(func(b []byte) {
+				sent = append(sent, toRadio(b))
+			}).Return(nil).Times(2)
+			Expect(mesh.RestoreFromFile(path)).Should(Succeed())
+			Expect(sent[0].GetSetRadio().GetChannelSettings().GetPsk()).Should(Equal([]byte{1, 2}))
+			Expect(proto.Equal(sent[1].GetSetOwner(), &message.User{LongName: "Base", ShortName: "B"})).Should(BeTrue())
 		})
 	})
 	Context("Close", func() {
@@ -112,8 +364,368 @@ var _ = Describe("Mesh", func() {
 			Expect(err).Should(HaveOccurred())
 		})
 	})
+	Context("SendPosition", func() {
+		var sent *message.MeshPacket
+		BeforeEach(func() {
+			sent = nil
+		})
+		It("should broadcast position", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(capturePacket(&sent)).Return(nil)
+			err := mesh.SendPosition(37.4219999, -122.0840575, 10, 90)
+			Expect(err).Should(BeNil())
+			Expect(sent.To).Should(Equal(uint32(BROADCAST_ADDR)))
+			pos := sent.GetDecoded().GetPosition()
+			Expect(pos.LatitudeI).Should(Equal(int32(374219999)))
+			Expect(pos.LongitudeI).Should(Equal(int32(-1220840575)))
+			Expect(pos.BatteryLevel).Should(Equal(int32(90)))
+			Expect(pos.Time).ShouldNot(BeZero())
+		})
+		It("should validate input", func() {
+			Expect(mesh.SendPosition(91, 0, 0, 0)).ShouldNot(Succeed())
+			Expect(mesh.SendPosition(0, -181, 0, 0)).ShouldNot(Succeed())
+			Expect(mesh.SendPosition(0, 0, 0, 101)).ShouldNot(Succeed())
+		})
+		It("should not override a radio gps", func() {
+			mesh.myInfo = &message.MyNodeInfo{HasGps: true}
+			Expect(mesh.SendPosition(1, 1, 0, 0)).ShouldNot(Succeed())
+		})
+		It("should sync the clock with the last position", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil)
+			Expect(mesh.SendPosition(1, 2, 0, 0)).Should(Succeed())
+
+			done := make(chan *message.MeshPacket, 1)
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).DoAndReturn(func(data []byte) error {
+				capturePacket(&sent)(data)
+				done <- sent
+				mesh.Close()
+				return nil
+			})
+			mockTransport.EXPECT().Close()
+			Expect(mesh.SyncClock(0)).ShouldNot(Succeed())
+			Expect(mesh.SyncClock(time.Millisecond)).Should(Succeed())
+			var pkt *message.MeshPacket
+			Eventually(done).Should(Receive(&pkt))
+			pos := pkt.GetDecoded().GetPosition()
+			Expect(pos.LatitudeI).Should(Equal(int32(10000000)))
+			Expect(pos.Time).Should(BeNumerically("~", time.Now().Unix(), 2))
+		})
+	})
+	Context("SendData", func() {
+		var sent *message.MeshPacket
+		It("should send opaque payloads", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(capturePacket(&sent)).Return(nil)
+			id, err := mesh.SendData(5, []byte{1, 2, 3}, WithAck())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sent.GetId()).Should(Equal(id))
+			Expect(sent.GetTo()).Should(Equal(uint32(5)))
+			Expect(sent.GetWantAck()).Should(BeTrue())
+			Expect(sent.GetDecoded().GetData().GetTyp()).Should(Equal(message.Data_OPAQUE))
+			Expect(sent.GetDecoded().GetData().GetPayload()).Should(Equal([]byte{1, 2, 3}))
+		})
+		It("should set the type", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(capturePacket(&sent)).Return(nil)
+			_, err := mesh.SendData(BROADCAST_ADDR, []byte("hi"), WithDataType(message.Data_CLEAR_TEXT), WithWantResponse())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sent.GetDecoded().GetData().GetTyp()).Should(Equal(message.Data_CLEAR_TEXT))
+			Expect(sent.GetDecoded().GetWantResponse()).Should(BeTrue())
+		})
+		It("should refuse payloads larger than the radio sends", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil)
+			_, err := mesh.SendData(5, make([]byte, DATA_PAYLOAD_LEN-10))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = mesh.SendData(5, make([]byte, DATA_PAYLOAD_LEN))
+			Expect(errors.Is(err, ErrPayloadTooLarge)).Should(BeTrue())
+			Expect(err.Error()).Should(Equal("payload too large: 246 bytes encoded, the radio sends at most 240"))
+		})
+		It("should hand received payloads to handlers by type", func() {
+			got := make(chan []byte, 2)
+			mesh.HandleData(message.Data_OPAQUE, func(pkt *message.MeshPacket, payload []byte) {
+				Expect(pkt.GetFrom()).Should(Equal(uint32(7)))
+				got <- payload
+			})
+			data := func(typ message.Data_Type, payload []byte) *message.MeshPacket {
+				return &message.MeshPacket{From: 7, Payload: &message.MeshPacket_Decoded{Decoded: &message.SubPacket{
+					Payload: &message.SubPacket_Data{Data: &message.Data{Typ: typ, Payload: payload}},
+				}}}
+			}
+			mesh.handlePacket(data(message.Data_CLEAR_TEXT, []byte("hi")))
+			mesh.handlePacket(&message.MeshPacket{From: 7})
+			mesh.handlePacket(data(message.Data_OPAQUE, []byte{9}))
+			Expect(got).Should(Receive(Equal([]byte{9})))
+			Expect(got).ShouldNot(Receive())
+		})
+	})
+	Context("receipts", func() {
+		var receipts chan *Receipt
+		var sent *message.MeshPacket
+		packet := func(from uint32, sub *message.SubPacket) *message.MeshPacket {
+			return &message.MeshPacket{From: from, To: 1, Id: 77, Payload: &message.MeshPacket_Decoded{Decoded: sub}}
+		}
+		BeforeEach(func() {
+			receipts = make(chan *Receipt, 3)
+			mesh.Subscribe(TOPIC_RECEIPT, func(r interface{}) {
+				receipts <- r.(*Receipt)
+			})
+		})
+		It("should report delivered and read separately", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(capturePacket(&sent)).Return(nil)
+			id, err := mesh.SendText(5, "hello")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sent.GetWantAck()).Should(BeTrue())
+			Expect(sent.GetDecoded().GetData().GetTyp()).Should(Equal(message.Data_CLEAR_TEXT))
+
+			mesh.handlePacket(packet(5, &message.SubPacket{Ack: &message.SubPacket_SuccessId{SuccessId: id}}))
+			var r *Receipt
+			Expect(receipts).Should(Receive(&r))
+			Expect(r.ID).Should(Equal(id))
+			Expect(r.From).Should(Equal(uint32(5)))
+			Expect(r.Status).Should(Equal(RECEIPT_DELIVERED))
+
+			readack := []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+			mesh.handlePacket(packet(5, &message.SubPacket{Payload: &message.SubPacket_Data{
+				Data: &message.Data{Typ: message.Data_CLEAR_READACK, Payload: readack},
+			}}))
+			Expect(receipts).Should(Receive(&r))
+			Expect(r.ID).Should(Equal(id))
+			Expect(r.Status.String()).Should(Equal("read"))
+		})
+		It("should report failed packets", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil)
+			id, err := mesh.SendText(5, "hello")
+			Expect(err).ShouldNot(HaveOccurred())
+			mesh.handlePacket(packet(5, &message.SubPacket{Ack: &message.SubPacket_FailId{FailId: id}}))
+			mesh.handlePacket(packet(5, &message.SubPacket{Ack: &message.SubPacket_FailId{FailId: id}}))
+			Expect(receipts).Should(Receive(WithTransform(func(r *Receipt) ReceiptStatus { return r.Status }, Equal(RECEIPT_FAILED))))
+			Expect(receipts).ShouldNot(Receive())
+		})
+		It("should mark text messages read", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(capturePacket(&sent)).Return(nil)
+			text := packet(5, &message.SubPacket{Payload: &message.SubPacket_Data{
+				Data: &message.Data{Typ: message.Data_CLEAR_TEXT, Payload: []byte("hi")},
+			}})
+			Expect(mesh.MarkRead(text)).Should(Succeed())
+			Expect(sent.GetTo()).Should(Equal(uint32(5)))
+			Expect(sent.GetDecoded().GetData().GetTyp()).Should(Equal(message.Data_CLEAR_READACK))
+			Expect(sent.GetDecoded().GetData().GetPayload()).Should(Equal([]byte{0, 0, 0, 77}))
+
+			Expect(mesh.MarkRead(packet(5, &message.SubPacket{}))).Should(Equal(ErrNotText))
+		})
+		It("should ignore malformed read acks", func() {
+			mesh.handlePacket(packet(5, &message.SubPacket{Payload: &message.SubPacket_Data{
+				Data: &message.Data{Typ: message.Data_CLEAR_READACK, Payload: []byte{1}},
+			}}))
+			Expect(receipts).ShouldNot(Receive())
+		})
+	})
+	Context("dedup", func() {
+		var got chan *message.MeshPacket
+		var statsMock *mt.MockStatsInterface
+		pkt := func(from, id uint32) *message.MeshPacket {
+			return &message.MeshPacket{From: from, Id: id, Payload: &message.MeshPacket_Decoded{Decoded: &message.SubPacket{}}}
+		}
+		BeforeEach(func() {
+			mesh.dedupWindow = time.Minute
+			statsMock = mt.NewMockStatsInterface(gomock.NewController(GinkgoT()))
+			statsMock.EXPECT().PacketReceived(gomock.Any()).AnyTimes()
+			mesh.stats = statsMock
+			got = make(chan *message.MeshPacket, 10)
+			mesh.Subscribe(TOPIC_DATA, func(p interface{}) {
+				got <- p.(*message.MeshPacket)
+			})
+		})
+		It("should drop copies of a packet", func() {
+			statsMock.EXPECT().DuplicateDropped(uint32(5)).Times(2)
+			mesh.handlePacket(pkt(5, 10))
+			mesh.handlePacket(pkt(5, 10))
+			mesh.handlePacket(pkt(6, 10))
+			mesh.handlePacket(pkt(5, 11))
+			mesh.handlePacket(pkt(5, 10))
+			Expect(got).Should(HaveLen(3))
+		})
+		It("should not drop packets without an id or when disabled", func() {
+			mesh.handlePacket(pkt(5, 0))
+			mesh.handlePacket(pkt(5, 0))
+			mesh.dedupWindow = 0
+			mesh.handlePacket(pkt(5, 10))
+			mesh.handlePacket(pkt(5, 10))
+			Expect(got).Should(HaveLen(4))
+		})
+		It("should forget packets after the window", func() {
+			t0 := time.Now()
+			c := &dedupCache{}
+			Expect(c.duplicate(5, 10, time.Minute, 100, t0)).Should(BeFalse())
+			Expect(c.duplicate(5, 10, time.Minute, 100, t0.Add(30*time.Second))).Should(BeTrue())
+			Expect(c.duplicate(5, 10, time.Minute, 100, t0.Add(2*time.Minute))).Should(BeFalse())
+			Expect(c.order).Should(HaveLen(1))
+		})
+		It("should be sized by the packet id space", func() {
+			c := &dedupCache{}
+			for id := uint32(1); id <= 5; id++ {
+				c.duplicate(5, id, time.Minute, 4, time.Now())
+			}
+			Expect(c.order).Should(HaveLen(4))
+			Expect(c.duplicate(5, 1, time.Minute, 4, time.Now())).Should(BeFalse())
+
+			Expect(dedupSize(nil)).Should(Equal(128))
+			Expect(dedupSize(&message.MyNodeInfo{PacketIdBits: 4})).Should(Equal(DEDUP_MIN_SIZE))
+			Expect(dedupSize(&message.MyNodeInfo{PacketIdBits: 12})).Should(Equal(2048))
+			Expect(dedupSize(&message.MyNodeInfo{PacketIdBits: 32})).Should(Equal(DEDUP_MAX_SIZE))
+		})
+	})
+	Context("ignore", func() {
+		var sent []*message.RadioConfig
+		capture := func(data []byte) {
+			sent = append(sent, toRadio(data).GetSetRadio())
+		}
+		BeforeEach(func() {
+			sent = nil
+			mesh.radioConfig = &message.RadioConfig{
+				Preferences: &message.RadioConfig_UserPreferences{LsSecs: 300, IgnoreIncoming: []uint32{9}},
+			}
+		})
+		It("should edit the ignore list in the radio config", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(capture).Return(nil).Times(2)
+			Expect(mesh.IgnoreNode(7)).Should(Succeed())
+			Expect(mesh.IgnoreNode(7)).Should(Succeed())
+			Expect(mesh.ListIgnored()).Should(Equal([]uint32{7, 9}))
+			Expect(mesh.UnignoreNode(9)).Should(Succeed())
+			Expect(mesh.UnignoreNode(9)).Should(Succeed())
+			Expect(mesh.ListIgnored()).Should(Equal([]uint32{7}))
+
+			Expect(sent).Should(HaveLen(2))
+			Expect(sent[0].GetPreferences().GetIgnoreIncoming()).Should(Equal([]uint32{9, 7}))
+			Expect(sent[0].GetPreferences().GetLsSecs()).Should(Equal(uint32(300)))
+			Expect(sent[1].GetPreferences().GetIgnoreIncoming()).Should(Equal([]uint32{7}))
+		})
+		It("should not lose concurrent writes", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil).Times(5)
+			done := make(chan error, 4)
+			for _, n := range []uint32{1, 2, 3, 4} {
+				go func(n uint32) { done <- mesh.IgnoreNode(n) }(n)
+			}
+			for i := 0; i < 4; i++ {
+				Expect(<-done).Should(Succeed())
+			}
+			Expect(mesh.ListIgnored()).Should(Equal([]uint32{1, 2, 3, 4, 9}))
+
+			// Edits start from what SetRadioConfig wrote
+			Expect(mesh.SetRadioConfig(&message.RadioConfig{Preferences: &message.RadioConfig_UserPreferences{LsSecs: 60}})).Should(Succeed())
+			Expect(mesh.ListIgnored()).Should(BeEmpty())
+		})
+		It("should not publish nodes learned from routes", func() {
+			nodes := make(chan *message.NodeInfo, 2)
+			mesh.Subscribe(TOPIC_NODE, func(n interface{}) {
+				nodes <- n.(*message.NodeInfo)
+			})
+			mesh.learnRoute([]uint32{1, 9, 8})
+			Expect(nodes).ShouldNot(Receive())
+			Expect(mesh.nodeList(false)).Should(HaveLen(2))
+			Expect(mesh.GetNodes()).Should(HaveLen(1))
+		})
+		It("should need the radio config", func() {
+			mesh.radioConfig = nil
+			Expect(mesh.IgnoreNode(7)).Should(Equal(ErrNoConfig))
+			Expect(mesh.ListIgnored()).Should(BeEmpty())
+		})
+		It("should not write in compatibility mode", func() {
+			mesh.compat = 1
+			Expect(mesh.IgnoreNode(7)).Should(Equal(ErrCompatMode))
+			Expect(mesh.ListIgnored()).Should(Equal([]uint32{9}))
+		})
+		It("should hide ignored nodes", func() {
+			nodes := make(chan *message.NodeInfo, 2)
+			mesh.Subscribe(TOPIC_NODE, func(n interface{}) {
+				nodes <- n.(*message.NodeInfo)
+			})
+			data := make(chan *message.MeshPacket, 2)
+			mesh.Subscribe(TOPIC_DATA, func(p interface{}) {
+				data <- p.(*message.MeshPacket)
+			})
+			go mesh.receiveFromRadio()
+			mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_NodeInfo{NodeInfo: &message.NodeInfo{Num: 9}}})
+			mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_NodeInfo{NodeInfo: &message.NodeInfo{Num: 8}}})
+			Eventually(nodes).Should(Receive(WithTransform(func(n *message.NodeInfo) uint32 { return n.GetNum() }, Equal(uint32(8)))))
+			Expect(nodes).ShouldNot(Receive())
+			Expect(mesh.GetNodes()).Should(HaveLen(1))
+
+			mesh.handlePacket(&message.MeshPacket{From: 9})
+			mesh.handlePacket(&message.MeshPacket{From: 8})
+			Expect(data).Should(Receive(WithTransform(func(p *message.MeshPacket) uint32 { return p.GetFrom() }, Equal(uint32(8)))))
+			Expect(data).ShouldNot(Receive())
+
+			// Backups keep the whole node list
+			mesh.setMyNodeInfo(&message.MyNodeInfo{MyNodeNum: 1})
+			ds, err := mesh.Backup()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ds.GetNodeDb()).Should(HaveLen(2))
+		})
+	})
+	Context("sendPacket", func() {
+		It("should pick ids away from the radio", func() {
+			mesh.myInfo = &message.MyNodeInfo{PacketIdBits: 8, CurrentPacketId: 10}
+			Expect(mesh.nextPacketID()).Should(Equal(uint32(10 + 127 + 1)))
+			mesh.myInfo = &message.MyNodeInfo{PacketIdBits: 32}
+			Expect(mesh.nextPacketID()).Should(Equal(uint32(0x7fffffff + 2)))
+		})
+		It("should never use id 0", func() {
+			mesh.myInfo = &message.MyNodeInfo{PacketIdBits: 8, CurrentPacketId: 128}
+			mesh.packetID = 0
+			Expect(mesh.nextPacketID()).Should(Equal(uint32(1)))
+		})
+	})
+	Context("stats", func() {
+		var statsMock *mt.MockStatsInterface
+		BeforeEach(func() {
+			statsMock = mt.NewMockStatsInterface(gomock.NewController(GinkgoT()))
+			mesh.stats = statsMock
+			go mesh.receiveFromRadio()
+		})
+		It("should report unmarshal failures and unsupported variants", func() {
+			done := make(chan bool, 2)
+			statsMock.EXPECT().UnmarshalFailed().Do(func() { done <- true })
+			statsMock.EXPECT().UnsupportedVariant("<nil>").Do(func(string) { done <- true })
+			mesh.rxChan <- []byte{0xff, 0xff, 0xff}
+			mesh.rxChan <- fromRadio(&message.FromRadio{Num: 1})
+			Eventually(done).Should(HaveLen(2))
+		})
+		It("should report ack latency", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil)
+			id, err := mesh.sendPacket(5, &message.SubPacket{}, true)
+			Expect(err).Should(BeNil())
+
+			done := make(chan time.Duration, 1)
+			statsMock.EXPECT().PacketReceived(gomock.Any()).Times(2)
+			statsMock.EXPECT().AckReceived(uint32(5), gomock.Any()).Do(func(_ uint32, d time.Duration) { done <- d })
+			ack := &message.FromRadio{
+				Variant: &message.FromRadio_Packet{
+					Packet: &message.MeshPacket{
+						From: 5,
+						Payload: &message.MeshPacket_Decoded{
+							Decoded: &message.SubPacket{
+								Ack: &message.SubPacket_SuccessId{SuccessId: id},
+							},
+						},
+					},
+				},
+			}
+			mesh.rxChan <- fromRadio(ack)
+			Eventually(done).Should(Receive(BeNumerically(">", 0)))
+
+			// Only reported once
+			mesh.rxChan <- fromRadio(ack)
+			Consistently(done).ShouldNot(Receive())
+		})
+	})
 	Context("receiveFromRadio", func() {
 		It("should work", func() {
+			nodes := make(chan *message.NodeInfo, 1)
+			mesh.Subscribe(TOPIC_NODE, func(n interface{}) {
+				nodes <- n.(*message.NodeInfo)
+			})
+			pkts := make(chan *message.MeshPacket, 1)
+			mesh.Subscribe(TOPIC_DATA, func(p interface{}) {
+				pkts <- p.(*message.MeshPacket)
+			})
 			go mesh.receiveFromRadio()
 
 			// Cover ConfigCompleteId
@@ -136,10 +748,7 @@ var _ = Describe("Mesh", func() {
 			mesh.rxChan <- fromRadio(pb)
 
 			Eventually(func() uint32 {
-				if mesh.myInfo != nil {
-					return mesh.myInfo.MyNodeNum
-				}
-				return 0
+				return mesh.GetMyNodeInfo().GetMyNodeNum()
 			}).Should(Equal(exp1))
 
 			// Should get RadioConfig
@@ -156,18 +765,10 @@ var _ = Describe("Mesh", func() {
 			mesh.rxChan <- fromRadio(pb)
 
 			Eventually(func() string {
-				if mesh.radioConfig != nil {
-					return mesh.radioConfig.ChannelSettings.Name
-				}
-				return ""
+				return mesh.GetRadioConfig().GetChannelSettings().GetName()
 			}).Should(Equal(exp2))
 
 			// Should get NodeInfo
-			var node *message.NodeInfo
-			cb := func(n interface{}) {
-				node = n.(*message.NodeInfo)
-			}
-			mesh.Subscribe(TOPIC_NODE, cb)
 			pb = &message.FromRadio{
 				Variant: &message.FromRadio_NodeInfo{
 					NodeInfo: &message.NodeInfo{
@@ -176,13 +777,188 @@ var _ = Describe("Mesh", func() {
 				},
 			}
 			mesh.rxChan <- fromRadio(pb)
+			Eventually(nodes).Should(Receive(WithTransform(func(n *message.NodeInfo) uint32 { return n.GetNum() }, Equal(exp1))))
 
-			Eventually(func() uint32 {
-				if node != nil {
-					return node.Num
-				}
-				return 0
-			}).Should(Equal(exp1))
+			// Should get MeshPacket
+			pb = &message.FromRadio{
+				Variant: &message.FromRadio_Packet{
+					Packet: &message.MeshPacket{
+						From: exp1,
+						Id:   42,
+					},
+				},
+			}
+			mesh.rxChan <- fromRadio(pb)
+			Eventually(pkts).Should(Receive(WithTransform(func(p *message.MeshPacket) uint32 { return p.GetId() }, Equal(uint32(42)))))
+		})
+		It("should stop on Close", func() {
+			stopped := make(chan bool)
+			go func() {
+				mesh.receiveFromRadio()
+				stopped <- true
+			}()
+			mockTransport.EXPECT().Close()
+			mesh.Close()
+			Eventually(stopped).Should(Receive())
+			mockTransport.EXPECT().Close()
+			mesh.Close()
+		})
+		It("should resync after a reboot", func() {
+			mesh.myInfo = &message.MyNodeInfo{MyNodeNum: 1}
+			mesh.radioConfig = &message.RadioConfig{}
+			rebooted := make(chan time.Time, 1)
+			mesh.Subscribe(TOPIC_REBOOTED, func(t interface{}) {
+				rebooted <- t.(time.Time)
+			})
+			go mesh.receiveFromRadio()
+			for _, n := range []uint32{9, 4} {
+				mesh.rxChan <- fromRadio(&message.FromRadio{
+					Variant: &message.FromRadio_NodeInfo{NodeInfo: &message.NodeInfo{Num: n}},
+				})
+			}
+			Eventually(mesh.GetNodes).Should(HaveLen(2))
+			Expect(mesh.GetNodes()[0].Num).Should(Equal(uint32(4)))
+
+			sent := make(chan []byte, 1)
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Do(func(b []byte) { sent <- b }).Return(nil)
+			mesh.rxChan <- fromRadio(&message.FromRadio{
+				Variant: &message.FromRadio_Rebooted{Rebooted: true},
+			})
+			Eventually(rebooted).Should(Receive())
+			Expect(mesh.GetNodes()).Should(BeEmpty())
+			Expect(mesh.GetMyNodeInfo()).Should(BeNil())
+			Expect(mesh.GetRadioConfig()).Should(BeNil())
+
+			req := toRadio(<-sent)
+			Expect(req.GetWantConfigId()).ShouldNot(BeZero())
+		})
+		It("should raise firmware errors when the count goes up", func() {
+			errs := make(chan *FirmwareError, 3)
+			mesh.Subscribe(TOPIC_FIRMWARE_ERROR, func(e interface{}) {
+				errs <- e.(*FirmwareError)
+			})
+			go mesh.receiveFromRadio()
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil).AnyTimes()
+			mesh.handleState(mt.STATE_CONNECTED)
+			Expect(mesh.Health().Healthy()).Should(BeTrue())
+
+			info := func(code, count uint32) []byte {
+				return fromRadio(&message.FromRadio{Variant: &message.FromRadio_MyInfo{MyInfo: &message.MyNodeInfo{
+					MyNodeNum: 7, ErrorCode: code, ErrorAddress: 0x40, ErrorCount: count, FirmwareVersion: "0.9.1",
+				}}})
+			}
+			mesh.rxChan <- info(uint32(ERR_UNSPECIFIED), 2) // faults from before we connected
+			mesh.rxChan <- info(uint32(ERR_NO_RADIO), 3)
+			mesh.rxChan <- info(uint32(ERR_NO_RADIO), 3) // same error read again
+
+			var fe *FirmwareError
+			Eventually(errs).Should(Receive(&fe))
+			Expect(fe.Code).Should(Equal(ERR_NO_RADIO))
+			Expect(fe.Error()).Should(Equal("radio !00000007 firmware error NoRadio at 0x40 (3 so far)"))
+			Consistently(errs, 20*time.Millisecond).ShouldNot(Receive())
+
+			// the count is kept over a reboot and the code is cleared once read
+			mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_Rebooted{Rebooted: true}})
+			mesh.rxChan <- info(uint32(ERR_NONE), 3)
+			Consistently(errs, 20*time.Millisecond).ShouldNot(Receive())
+			mesh.rxChan <- info(uint32(ERR_TX_WATCHDOG), 4)
+			Eventually(errs).Should(Receive(&fe))
+			Expect(fe.Code).Should(Equal(ERR_TX_WATCHDOG))
+
+			h := mesh.Health()
+			Expect(h.Healthy()).Should(BeFalse())
+			Expect(h.Errors).Should(Equal(uint32(2)))
+			Expect(h.LastError).Should(Equal(fe))
+			Expect(h.FirmwareVersion).Should(Equal("0.9.1"))
+			Expect(FirmwareErrorCode(99).String()).Should(Equal("Unknown(99)"))
+		})
+		It("should publish debug output", func() {
+			buf := &bytes.Buffer{}
+			mesh.debugOut = buf
+			mesh.Subscribe(TOPIC_DEBUG, mesh.writeDebug)
+			lines := make(chan string, 2)
+			mesh.Subscribe(TOPIC_DEBUG, func(l interface{}) {
+				lines <- l.(string)
+			})
+			go mesh.receiveFromRadio()
+
+			mesh.rxChan <- fromRadio(&message.FromRadio{
+				Variant: &message.FromRadio_DebugString{
+					DebugString: &message.DebugString{Message: "assert failed\r\n"},
+				},
+			})
+			Eventually(lines).Should(Receive(Equal("assert failed")))
+
+			// console lines from the transport
+			mesh.handleDebug("Booted\n")
+			Eventually(lines).Should(Receive(Equal("Booted")))
+			mesh.handleDebug("")
+			Consistently(lines, 10*time.Millisecond).ShouldNot(Receive())
+			Expect(buf.String()).Should(Equal("assert failed\nBooted\n"))
+		})
+	})
+	Context("DiscoverRoute", func() {
+		// reply answers the RouteRequest sent to the mock radio with pkt
+		reply := func(pkt func(req *message.MeshPacket) *message.MeshPacket) {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).DoAndReturn(func(b []byte) error {
+				req := toRadio(b)
+				Expect(req.GetPacket().GetDecoded().GetRouteRequest()).ShouldNot(BeNil())
+				mesh.rxChan <- fromRadio(&message.FromRadio{Variant: &message.FromRadio_Packet{Packet: pkt(req.GetPacket())}})
+				return nil
+			})
+		}
+		BeforeEach(func() {
+			mesh.myInfo = &message.MyNodeInfo{MyNodeNum: 1}
+			mesh.nodes[3] = &message.NodeInfo{Num: 3, Snr: 5}
+		})
+		It("should return the hops and learn next hops", func() {
+			routes := make(chan *Route, 1)
+			mesh.Subscribe(TOPIC_ROUTE, func(r interface{}) {
+				routes <- r.(*Route)
+			})
+			go mesh.receiveFromRadio()
+			reply(func(req *message.MeshPacket) *message.MeshPacket {
+				Expect(req.GetTo()).Should(Equal(uint32(3)))
+				Expect(req.GetDecoded().GetDest()).Should(Equal(uint32(3)))
+				return &message.MeshPacket{From: 3, To: 1, Payload: &message.MeshPacket_Decoded{Decoded: &message.SubPacket{
+					Payload: &message.SubPacket_RouteReply{RouteReply: &message.RouteDiscovery{Route: []int32{1, 2}}},
+				}}}
+			})
+			old := mesh.nodes[3]
+			hops, err := mesh.DiscoverRoute(context.Background(), 3)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(hops).Should(Equal([]uint32{1, 2, 3}))
+			Eventually(routes).Should(Receive())
+
+			nodes := mesh.GetNodes()
+			Expect(nodes).Should(HaveLen(2))
+			Expect(nodes[0].GetNum()).Should(Equal(uint32(2)))
+			Expect(nodes[0].GetNextHop()).Should(Equal(uint32(2)))
+			Expect(nodes[1].GetNextHop()).Should(Equal(uint32(2)))
+			Expect(nodes[1].GetSnr()).Should(Equal(float32(5)))
+			Expect(old.GetNextHop()).Should(BeZero())
+		})
+		It("should return route errors", func() {
+			mesh.nodes[3].NextHop = 2
+			go mesh.receiveFromRadio()
+			reply(func(req *message.MeshPacket) *message.MeshPacket {
+				return &message.MeshPacket{From: 2, To: 1, Payload: &message.MeshPacket_Decoded{Decoded: &message.SubPacket{
+					Payload:    &message.SubPacket_RouteError{RouteError: message.RouteError_NO_ROUTE},
+					OriginalId: req.GetId(),
+				}}}
+			})
+			_, err := mesh.DiscoverRoute(context.Background(), 3)
+			Expect(errors.Is(err, ErrRouteFailed)).Should(BeTrue())
+			Expect(err.Error()).Should(Equal("route discovery failed to !00000003: NO_ROUTE"))
+			Eventually(func() uint32 { return mesh.GetNodes()[0].GetNextHop() }).Should(BeZero())
+		})
+		It("should give up when ctx is done", func() {
+			mockTransport.EXPECT().SendToRadio(gomock.Any()).Return(nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := mesh.DiscoverRoute(ctx, 3)
+			Expect(err).Should(Equal(context.DeadlineExceeded))
+			Expect(mesh.routes.pending).Should(BeEmpty())
 		})
 	})
 })
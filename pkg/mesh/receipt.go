@@ -0,0 +1,81 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+)
+
+// ReceiptStatus is how far a sent packet got
+type ReceiptStatus int
+
+const (
+	RECEIPT_DELIVERED ReceiptStatus = iota // the mesh acked it
+	RECEIPT_READ                           // the recipient sent a CLEAR_READACK
+	RECEIPT_FAILED                         // the mesh gave up delivering it
+)
+
+func (s ReceiptStatus) String() string {
+	switch s {
+	case RECEIPT_DELIVERED:
+		return "delivered"
+	case RECEIPT_READ:
+		return "read"
+	case RECEIPT_FAILED:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Receipt is published on TOPIC_RECEIPT for a packet we sent
+type Receipt struct {
+	ID     uint32 // of the packet we sent, as returned by SendText or SendData
+	From   uint32 // node the receipt came from
+	Status ReceiptStatus
+	Time   time.Time
+}
+
+// A CLEAR_READACK payload is the id of the packet that was read
+const READACK_LEN = 4
+
+var ErrNotText = errors.New("only received text messages can be marked read")
+
+// SendText sends a CLEAR_TEXT message and returns its id. Messages to a node
+// want an ack, so TOPIC_RECEIPT reports them delivered.
+func (m *Mesh) SendText(to uint32, text string) (uint32, error) {
+	opts := []DataOption{WithDataType(message.Data_CLEAR_TEXT)}
+	if to != BROADCAST_ADDR {
+		opts = append(opts, WithAck())
+	}
+	return m.SendData(to, []byte(text), opts...)
+}
+
+// MarkRead tells the sender of a received text message that it was read
+func (m *Mesh) MarkRead(pkt *message.MeshPacket) error {
+	data := pkt.GetDecoded().GetData()
+	if data == nil || data.GetTyp() != message.Data_CLEAR_TEXT || pkt.GetId() == 0 {
+		return ErrNotText
+	}
+	payload := make([]byte, READACK_LEN)
+	binary.BigEndian.PutUint32(payload, pkt.GetId())
+	m.logger.WithField(mt.FIELD_NODE, pkt.GetFrom()).WithField(mt.FIELD_PACKET_ID, pkt.GetId()).Debug("sending read ack")
+	_, err := m.SendData(pkt.GetFrom(), payload, WithDataType(message.Data_CLEAR_READACK))
+	return err
+}
+
+// handleReadAck publishes a RECEIPT_READ for the packet a CLEAR_READACK refers to
+func (m *Mesh) handleReadAck(pkt *message.MeshPacket) {
+	payload := pkt.GetDecoded().GetData().GetPayload()
+	if len(payload) != READACK_LEN {
+		m.logger.WithField(mt.FIELD_NODE, pkt.GetFrom()).Warn("ignoring malformed read ack")
+		return
+	}
+	m.receipt(binary.BigEndian.Uint32(payload), pkt.GetFrom(), RECEIPT_READ)
+}
+
+func (m *Mesh) receipt(id, from uint32, st ReceiptStatus) {
+	m.pub(TOPIC_RECEIPT, &Receipt{ID: id, From: from, Status: st, Time: time.Now()})
+}
@@ -0,0 +1,217 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+)
+
+var ErrRouteFailed = errors.New("route discovery failed")
+
+// RouteError is a RouteError the mesh sent back for a DiscoverRoute, it matches ErrRouteFailed with errors.Is
+type RouteError struct {
+	Dest   uint32
+	Reason message.RouteError
+}
+
+func (e *RouteError) Error() string {
+	return fmt.Sprintf("%s to !%08x: %s", ErrRouteFailed, e.Dest, e.Reason)
+}
+
+func (e *RouteError) Unwrap() error {
+	return ErrRouteFailed
+}
+
+// Route is a path through the mesh learned from a RouteReply
+type Route struct {
+	Dest uint32
+	// Nodes from us to Dest, both included
+	Hops []uint32
+	Time time.Time
+}
+
+// routeResult is what a DiscoverRoute waiter gets
+type routeResult struct {
+	route *Route
+	err   error
+}
+
+// routeWaiters are the DiscoverRoute calls waiting for a reply, by destination
+type routeWaiters struct {
+	mu      sync.Mutex
+	pending map[uint32][]routeWaiter
+}
+
+type routeWaiter struct {
+	id uint32 // of the RouteRequest, a RouteError refers to it
+	ch chan routeResult
+}
+
+func (w *routeWaiters) add(dest, id uint32) chan routeResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending == nil {
+		w.pending = make(map[uint32][]routeWaiter)
+	}
+	ch := make(chan routeResult, 1)
+	w.pending[dest] = append(w.pending[dest], routeWaiter{id, ch})
+	return ch
+}
+
+func (w *routeWaiters) remove(dest uint32, ch chan routeResult) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ws := w.pending[dest]
+	for i, r := range ws {
+		if r.ch == ch {
+			w.pending[dest] = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(w.pending[dest]) == 0 {
+		delete(w.pending, dest)
+	}
+}
+
+// resolve hands res to every waiter for dest
+func (w *routeWaiters) resolve(dest uint32, res routeResult) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, r := range w.pending[dest] {
+		r.ch <- res
+	}
+	delete(w.pending, dest)
+}
+
+// fail hands err to the waiter whose request had id, false if there is none
+func (w *routeWaiters) fail(id uint32, err *RouteError) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for dest, ws := range w.pending {
+		for i, r := range ws {
+			if r.id == id {
+				err.Dest = dest
+				r.ch <- routeResult{err: err}
+				w.pending[dest] = append(ws[:i], ws[i+1:]...)
+				if len(w.pending[dest]) == 0 {
+					delete(w.pending, dest)
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DiscoverRoute sends a RouteRequest to dest and waits for the RouteReply or RouteError.
+// The returned hops start with our node and end with dest. Cancel ctx to give up waiting.
+func (m *Mesh) DiscoverRoute(ctx context.Context, dest uint32) ([]uint32, error) {
+	if dest == BROADCAST_ADDR {
+		return nil, errors.New("cannot discover a route to the broadcast address")
+	}
+	// Register before sending, the reply can arrive before sendPacket returns
+	id := m.nextPacketID()
+	ch := m.routes.add(dest, id)
+	sub := &message.SubPacket{
+		Payload: &message.SubPacket_RouteRequest{RouteRequest: &message.RouteDiscovery{}},
+		Dest:    dest,
+	}
+	m.logger.WithField(mt.FIELD_NODE, dest).Debug("sending route request")
+	err := m.sendPacketWithID(id, dest, sub, false)
+	if err != nil {
+		m.routes.remove(dest, ch)
+		return nil, err
+	}
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return res.route.Hops, nil
+	case <-ctx.Done():
+		m.routes.remove(dest, ch)
+		return nil, ctx.Err()
+	}
+}
+
+// handleRouteReply learns the route in a RouteReply, solicited or not
+func (m *Mesh) handleRouteReply(pkt *message.MeshPacket) {
+	sub := pkt.GetDecoded()
+	dest := pkt.GetFrom()
+	if sub.GetSource() != 0 {
+		dest = sub.GetSource()
+	}
+	r := &Route{
+		Dest: dest,
+		Hops: m.routeHops(dest, sub.GetRouteReply().GetRoute()),
+		Time: time.Now(),
+	}
+	m.logger.WithField(mt.FIELD_NODE, dest).WithField("hops", r.Hops).Debug("got route reply")
+	m.learnRoute(r.Hops)
+	m.routes.resolve(dest, routeResult{route: r})
+	m.pub(TOPIC_ROUTE, r)
+}
+
+// handleRouteError fails the DiscoverRoute the error refers to and forgets the next hop
+func (m *Mesh) handleRouteError(pkt *message.MeshPacket) {
+	sub := pkt.GetDecoded()
+	rerr := &RouteError{Dest: sub.GetDest(), Reason: sub.GetRouteError()}
+	m.logger.WithField(mt.FIELD_PACKET_ID, sub.GetOriginalId()).WithError(rerr).Debug("got route error")
+	if !m.routes.fail(sub.GetOriginalId(), rerr) && rerr.Dest != 0 {
+		m.routes.resolve(rerr.Dest, routeResult{err: rerr})
+	}
+	if rerr.Dest != 0 {
+		m.setNextHop(rerr.Dest, 0)
+	}
+}
+
+// routeHops puts our node and dest around the nodes a RouteDiscovery visited, if it left them out
+func (m *Mesh) routeHops(dest uint32, route []int32) []uint32 {
+	me := m.GetMyNodeInfo().GetMyNodeNum()
+	hops := make([]uint32, 0, len(route)+2)
+	if len(route) == 0 || uint32(route[0]) != me {
+		hops = append(hops, me)
+	}
+	for _, n := range route {
+		hops = append(hops, uint32(n))
+	}
+	if hops[len(hops)-1] != dest {
+		hops = append(hops, dest)
+	}
+	return hops
+}
+
+// learnRoute sets NextHop of every node on the route to the first hop after us
+func (m *Mesh) learnRoute(hops []uint32) {
+	if len(hops) < 2 {
+		return
+	}
+	for _, n := range hops[1:] {
+		m.setNextHop(n, hops[1])
+	}
+}
+
+// setNextHop replaces the node's NodeInfo with a copy, subscribers may hold the old one.
+// The change is not published on TOPIC_NODE, which only carries NodeInfo from the radio,
+// the routes are on TOPIC_ROUTE.
+func (m *Mesh) setNextHop(num, hop uint32) {
+	m.nodeMu.Lock()
+	defer m.nodeMu.Unlock()
+	old := m.nodes[num]
+	if old.GetNextHop() == hop {
+		return
+	}
+	node := &message.NodeInfo{Num: num}
+	if old != nil {
+		node = proto.Clone(old).(*message.NodeInfo)
+	}
+	node.NextHop = hop
+	m.nodes[num] = node
+}
@@ -0,0 +1,139 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// APP_VERSION is compared with MyNodeInfo.MinAppVersion, it is the Android app
+	// build the pinned protobufs were released with
+	APP_VERSION = 172
+
+	// Oldest firmware that answers WantConfigId with ConfigCompleteId
+	MIN_FIRMWARE_VERSION = "0.8.0"
+)
+
+// CompatMode is what Connect does when the firmware is not compatible with the library
+type CompatMode int
+
+const (
+	COMPAT_STRICT    CompatMode = iota // Connect returns ErrIncompatibleFirmware
+	COMPAT_DOWNGRADE                   // Connect succeeds, config writes are refused with ErrCompatMode
+)
+
+var (
+	ErrIncompatibleFirmware = errors.New("incompatible firmware")
+	// Returned by calls that write to the radio when connected in COMPAT_DOWNGRADE mode
+	ErrCompatMode = errors.New("not supported in compatibility mode")
+)
+
+// FirmwareVersionError tells why the firmware is incompatible, it matches ErrIncompatibleFirmware with errors.Is
+type FirmwareVersionError struct {
+	FirmwareVersion string
+	MinAppVersion   uint32
+	Reason          string
+}
+
+func (e *FirmwareVersionError) Error() string {
+	return fmt.Sprintf("%s %q: %s", ErrIncompatibleFirmware, e.FirmwareVersion, e.Reason)
+}
+
+func (e *FirmwareVersionError) Unwrap() error {
+	return ErrIncompatibleFirmware
+}
+
+// Version is a parsed firmware version, e.g. "0.9.1"
+type Version struct {
+	Major, Minor, Patch int
+}
+
+// ParseVersion accepts major.minor.patch with an optional leading v and a trailing -suffix
+func ParseVersion(s string) (Version, error) {
+	v := Version{}
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+ "); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		nums[i] = n
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return v, nil
+}
+
+// Less compares versions field by field
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// checkFirmware returns a *FirmwareVersionError if the radio needs a newer app or has older firmware than we support
+func checkFirmware(fw string, minApp uint32) error {
+	if minApp > APP_VERSION {
+		return &FirmwareVersionError{fw, minApp,
+			fmt.Sprintf("radio needs app version %d, library is %d", minApp, APP_VERSION)}
+	}
+	v, err := ParseVersion(fw)
+	if err != nil {
+		return &FirmwareVersionError{fw, minApp, err.Error()}
+	}
+	min, _ := ParseVersion(MIN_FIRMWARE_VERSION)
+	if v.Less(min) {
+		return &FirmwareVersionError{fw, minApp, "older than " + MIN_FIRMWARE_VERSION}
+	}
+	return nil
+}
+
+// negotiate checks the MyNodeInfo the radio sent while connecting or after a reboot
+func (m *Mesh) negotiate() error {
+	info := m.GetMyNodeInfo()
+	err := checkFirmware(info.GetFirmwareVersion(), info.GetMinAppVersion())
+	if err == nil {
+		atomic.StoreUint32(&m.compat, 0)
+		return nil
+	}
+	if m.compatMode == COMPAT_STRICT {
+		m.logger.WithError(err).Error("radio firmware is not compatible")
+		return err
+	}
+	m.logger.WithError(err).Warn("radio firmware is not compatible, continuing in compatibility mode")
+	atomic.StoreUint32(&m.compat, 1)
+	return nil
+}
+
+// negotiateAfterReboot runs on the receive goroutine when the config after a reboot is in.
+// Firmware flashed in the meantime may no longer be compatible, in COMPAT_STRICT the
+// connection is closed as Connect would have refused it.
+func (m *Mesh) negotiateAfterReboot() {
+	if m.negotiate() != nil {
+		// Close waits for the transport, which may wait for this goroutine
+		go m.Close()
+	}
+}
+
+// Compat is true after Connect or a reboot downgraded to compatibility mode, see WithCompatMode
+func (m *Mesh) Compat() bool {
+	return atomic.LoadUint32(&m.compat) == 1
+}
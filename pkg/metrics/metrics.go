@@ -0,0 +1,220 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+)
+
+const (
+	NAMESPACE = "meshtastic"
+	PATH      = "/metrics"
+)
+
+// Collector implements types.StatsInterface and prometheus.Collector.
+// Pass it to mesh.NewMesh with mesh.WithStats to instrument a mesh.
+type Collector struct {
+	framesReceived    prometheus.Counter
+	framesSent        prometheus.Counter
+	framesDiscarded   prometheus.Counter
+	unmarshalFailures prometheus.Counter
+	unsupported       *prometheus.CounterVec
+	packets           *prometheus.CounterVec
+	snr               *prometheus.GaugeVec
+	battery           *prometheus.GaugeVec
+	ackLatency        *prometheus.HistogramVec
+	firmwareErrors    *prometheus.CounterVec
+	duplicates        *prometheus.CounterVec
+	lastHeardDesc     *prometheus.Desc
+
+	mu        sync.Mutex
+	lastHeard map[uint32]time.Time
+	now       func() time.Time
+}
+
+var _ mt.StatsInterface = (*Collector)(nil)
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a Collector, register it or use Handler to serve it
+func NewCollector() *Collector {
+	nodeLabel := []string{"node"}
+	return &Collector{
+		framesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: NAMESPACE, Name: "frames_received_total",
+			Help: "Frames received from the radio transport.",
+		}),
+		framesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: NAMESPACE, Name: "frames_sent_total",
+			Help: "Frames sent to the radio transport.",
+		}),
+		framesDiscarded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: NAMESPACE, Name: "frames_discarded_total",
+			Help: "Frames discarded for exceeding PACKET_MTU.",
+		}),
+		unmarshalFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: NAMESPACE, Name: "unmarshal_failures_total",
+			Help: "FromRadio messages that could not be unmarshalled.",
+		}),
+		unsupported: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: NAMESPACE, Name: "unsupported_variants_total",
+			Help: "FromRadio messages with a variant the library does not handle.",
+		}, []string{"variant"}),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: NAMESPACE, Name: "packets_received_total",
+			Help: "Mesh packets received per sending node.",
+		}, nodeLabel),
+		snr: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: NAMESPACE, Name: "node_snr_db",
+			Help: "Last SNR heard from a node.",
+		}, nodeLabel),
+		battery: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: NAMESPACE, Name: "node_battery_percent",
+			Help: "Last battery level reported by a node.",
+		}, nodeLabel),
+		ackLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: NAMESPACE, Name: "ack_latency_seconds",
+			Help:    "Time from sending a packet to receiving its ack.",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+		}, nodeLabel),
+		firmwareErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: NAMESPACE, Name: "firmware_errors_total",
+			Help: "Critical faults reported by a radio in MyNodeInfo.",
+		}, []string{"node", "code"}),
+		duplicates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: NAMESPACE, Name: "duplicates_dropped_total",
+			Help: "Mesh packets received again and dropped per sending node.",
+		}, nodeLabel),
+		lastHeardDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(NAMESPACE, "", "node_last_heard_age_seconds"),
+			"Seconds since anything was last heard from a node.",
+			nodeLabel, nil,
+		),
+		lastHeard: make(map[uint32]time.Time),
+		now:       time.Now,
+	}
+}
+
+// Handler serves the collector, and only the collector, in the prometheus text format
+func (c *Collector) Handler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe serves the collector on addr at PATH, it blocks like http.ListenAndServe
+func (c *Collector) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle(PATH, c.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+func (c *Collector) FrameReceived() { c.framesReceived.Inc() }
+
+func (c *Collector) FrameSent() { c.framesSent.Inc() }
+
+func (c *Collector) FrameDiscarded(size int) { c.framesDiscarded.Inc() }
+
+func (c *Collector) UnmarshalFailed() { c.unmarshalFailures.Inc() }
+
+func (c *Collector) UnsupportedVariant(variant string) {
+	c.unsupported.WithLabelValues(variant).Inc()
+}
+
+func (c *Collector) PacketReceived(pkt *message.MeshPacket) {
+	node := nodeName(pkt.From)
+	c.packets.WithLabelValues(node).Inc()
+	// 0 dB is a reading too, the gauge would keep the previous one
+	c.snr.WithLabelValues(node).Set(float64(pkt.RxSnr))
+	if bat := pkt.GetDecoded().GetPosition().GetBatteryLevel(); bat != 0 {
+		c.battery.WithLabelValues(node).Set(float64(bat))
+	}
+	c.heard(pkt.From)
+}
+
+func (c *Collector) NodeUpdated(node *message.NodeInfo) {
+	name := nodeName(node.Num)
+	c.snr.WithLabelValues(name).Set(float64(node.Snr))
+	if bat := node.GetPosition().GetBatteryLevel(); bat != 0 {
+		c.battery.WithLabelValues(name).Set(float64(bat))
+	}
+	if node.Position != nil && node.Position.Time != 0 {
+		c.heardAt(node.Num, time.Unix(int64(node.Position.Time), 0))
+	}
+}
+
+func (c *Collector) AckReceived(node uint32, latency time.Duration) {
+	c.ackLatency.WithLabelValues(nodeName(node)).Observe(latency.Seconds())
+	c.heard(node)
+}
+
+func (c *Collector) FirmwareError(node uint32, code string) {
+	c.firmwareErrors.WithLabelValues(nodeName(node), code).Inc()
+}
+
+func (c *Collector) DuplicateDropped(node uint32) {
+	c.duplicates.WithLabelValues(nodeName(node)).Inc()
+}
+
+func (c *Collector) heard(node uint32) {
+	c.heardAt(node, c.now())
+}
+
+// heardAt never moves last heard backwards
+func (c *Collector) heardAt(node uint32, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.lastHeard[node]) {
+		c.lastHeard[node] = t
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.framesReceived.Describe(ch)
+	c.framesSent.Describe(ch)
+	c.framesDiscarded.Describe(ch)
+	c.unmarshalFailures.Describe(ch)
+	c.unsupported.Describe(ch)
+	c.packets.Describe(ch)
+	c.snr.Describe(ch)
+	c.battery.Describe(ch)
+	c.ackLatency.Describe(ch)
+	c.firmwareErrors.Describe(ch)
+	c.duplicates.Describe(ch)
+	ch <- c.lastHeardDesc
+}
+
+// Collect implements prometheus.Collector, last heard age is computed at scrape time
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.framesReceived.Collect(ch)
+	c.framesSent.Collect(ch)
+	c.framesDiscarded.Collect(ch)
+	c.unmarshalFailures.Collect(ch)
+	c.unsupported.Collect(ch)
+	c.packets.Collect(ch)
+	c.snr.Collect(ch)
+	c.battery.Collect(ch)
+	c.ackLatency.Collect(ch)
+	c.firmwareErrors.Collect(ch)
+	c.duplicates.Collect(ch)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for node, t := range c.lastHeard {
+		ch <- prometheus.MustNewConstMetric(c.lastHeardDesc, prometheus.GaugeValue,
+			now.Sub(t).Seconds(), nodeName(node))
+	}
+}
+
+// nodeName formats a node number the way the apps display it
+func nodeName(num uint32) string {
+	return fmt.Sprintf("!%08x", num)
+}
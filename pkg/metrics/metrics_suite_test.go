@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Metrics Suite")
+}
+
+var _ = Describe("metrics", func() {
+	var c *Collector
+	t0 := time.Unix(1594000000, 0)
+	BeforeEach(func() {
+		c = NewCollector()
+		c.now = func() time.Time { return t0 }
+	})
+	It("should count frames", func() {
+		c.FrameReceived()
+		c.FrameReceived()
+		c.FrameSent()
+		c.FrameDiscarded(600)
+		c.UnmarshalFailed()
+		c.UnsupportedVariant("*message.FromRadio_Rebooted")
+		c.FirmwareError(0x99, "NoRadio")
+		c.DuplicateDropped(0x99)
+		Expect(testutil.ToFloat64(c.framesReceived)).Should(Equal(2.0))
+		Expect(testutil.ToFloat64(c.framesSent)).Should(Equal(1.0))
+		Expect(testutil.ToFloat64(c.framesDiscarded)).Should(Equal(1.0))
+		Expect(testutil.ToFloat64(c.unmarshalFailures)).Should(Equal(1.0))
+		Expect(testutil.ToFloat64(c.unsupported.WithLabelValues("*message.FromRadio_Rebooted"))).Should(Equal(1.0))
+		Expect(testutil.ToFloat64(c.firmwareErrors.WithLabelValues("!00000099", "NoRadio"))).Should(Equal(1.0))
+		Expect(testutil.ToFloat64(c.duplicates.WithLabelValues("!00000099"))).Should(Equal(1.0))
+	})
+	It("should track nodes", func() {
+		c.PacketReceived(&message.MeshPacket{
+			From:  0x1234,
+			RxSnr: 6.5,
+			Payload: &message.MeshPacket_Decoded{
+				Decoded: &message.SubPacket{
+					Payload: &message.SubPacket_Position{
+						Position: &message.Position{BatteryLevel: 55},
+					},
+				},
+			},
+		})
+		c.NodeUpdated(&message.NodeInfo{Num: 0x99, Snr: -2})
+		Expect(testutil.ToFloat64(c.snr.WithLabelValues("!00001234"))).Should(Equal(6.5))
+		Expect(testutil.ToFloat64(c.battery.WithLabelValues("!00001234"))).Should(Equal(55.0))
+		Expect(testutil.ToFloat64(c.snr.WithLabelValues("!00000099"))).Should(Equal(-2.0))
+		Expect(testutil.ToFloat64(c.packets.WithLabelValues("!00001234"))).Should(Equal(1.0))
+	})
+	It("should keep 0 dB readings", func() {
+		c.PacketReceived(&message.MeshPacket{From: 0x1234, RxSnr: 6.5})
+		c.PacketReceived(&message.MeshPacket{From: 0x1234})
+		Expect(testutil.ToFloat64(c.snr.WithLabelValues("!00001234"))).Should(Equal(0.0))
+	})
+	It("should compute last heard age at scrape time", func() {
+		c.PacketReceived(&message.MeshPacket{From: 1})
+		c.AckReceived(2, 1500*time.Millisecond)
+		c.NodeUpdated(&message.NodeInfo{Num: 1, Position: &message.Position{Time: 1593999000}})
+		c.now = func() time.Time { return t0.Add(30 * time.Second) }
+
+		exp := `
+# HELP meshtastic_node_last_heard_age_seconds Seconds since anything was last heard from a node.
+# TYPE meshtastic_node_last_heard_age_seconds gauge
+meshtastic_node_last_heard_age_seconds{node="!00000001"} 30
+meshtastic_node_last_heard_age_seconds{node="!00000002"} 30
+`
+		err := testutil.CollectAndCompare(c, strings.NewReader(exp), "meshtastic_node_last_heard_age_seconds")
+		Expect(err).Should(BeNil())
+	})
+	It("should serve metrics", func() {
+		c.AckReceived(2, 1500*time.Millisecond)
+		srv := httptest.NewServer(c.Handler())
+		defer srv.Close()
+		resp, err := srv.Client().Get(srv.URL + PATH)
+		Expect(err).Should(BeNil())
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(string(body)).Should(ContainSubstring(`meshtastic_ack_latency_seconds_count{node="!00000002"} 1`))
+		Expect(string(body)).Should(ContainSubstring("meshtastic_frames_received_total 0"))
+	})
+})
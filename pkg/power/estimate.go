@@ -0,0 +1,95 @@
+package power
+
+import (
+	"math"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+)
+
+// Model is the current a board draws in each power state
+type Model struct {
+	AwakeMA      float64 // CPU, bluetooth and the radio listening
+	ScreenMA     float64 // on top of AwakeMA while the screen is on
+	LightSleepMA float64
+	DeepSleepMA  float64
+	TxMA         float64 // on top of AwakeMA while transmitting
+	TxSecs       float64 // airtime of a position broadcast
+}
+
+// DEFAULT_MODEL is in the range of an ESP32 board with a GPS on the default channel.
+// Boards differ a lot, measure yours for better estimates.
+var DEFAULT_MODEL = Model{
+	AwakeMA:      60,
+	ScreenMA:     10,
+	LightSleepMA: 6,
+	DeepSleepMA:  0.5,
+	TxMA:         100,
+	TxSecs:       1.5,
+}
+
+// Estimate is the power use of an idle radio: no phone connected and nothing
+// heard from the mesh, only its own position broadcasts.
+type Estimate struct {
+	DutyCycle float64 // fraction of the time the CPU is awake
+	AverageMA float64
+	// How often positions go out while not in super deep sleep, light sleep delays
+	// them to the next wake up
+	PositionSecs uint32
+	DeepSleep    bool          // the radio goes to super deep sleep and stops relaying
+	Life         time.Duration // on the battery given to Estimate, 0 without one or when Unbounded
+	// The model draws nothing on average, or so little that Life does not fit a Duration
+	Unbounded bool
+}
+
+// EstimateLife estimates the duty cycle and battery life prefs imply on a board
+// drawing what model says, with a battery of batteryMAh.
+func EstimateLife(prefs *message.RadioConfig_UserPreferences, model Model, batteryMAh float64) Estimate {
+	p := WithDefaults(prefs)
+	alwaysOn := p.WaitBluetoothSecs == NEVER
+	cycle := float64(p.LsSecs) + float64(p.MinWakeSecs)
+	pos := float64(p.PositionBroadcastSecs)
+	lsDuty := float64(p.MinWakeSecs) / cycle
+	if !alwaysOn {
+		pos = math.Ceil(pos/cycle) * cycle
+	}
+	txMA := model.TxMA * model.TxSecs / pos
+	lsMA := lsDuty*model.AwakeMA + (1-lsDuty)*model.LightSleepMA
+
+	est := Estimate{PositionSecs: uint32(pos)}
+	timeout := sdsTimeout(p)
+	switch {
+	case timeout == NEVER && alwaysOn:
+		est.DutyCycle = 1
+		est.AverageMA = model.AwakeMA + txMA
+	case timeout == NEVER:
+		est.DutyCycle = lsDuty
+		est.AverageMA = lsMA + txMA
+	case p.SdsSecs == NEVER:
+		// Asleep for good until a button press
+		est.DeepSleep = true
+		est.AverageMA = model.DeepSleepMA
+	default:
+		// Screen on, screen off waiting for a phone, light sleep, then super deep
+		// sleep. The radio reboots after it and starts over.
+		est.DeepSleep = true
+		t := float64(timeout)
+		screen := math.Min(float64(p.ScreenOnSecs), t)
+		dark := math.Min(float64(p.WaitBluetoothSecs), t-screen)
+		ls := t - screen - dark
+		sds := float64(p.SdsSecs)
+		period := t + sds
+		charge := screen*(model.AwakeMA+model.ScreenMA) + dark*model.AwakeMA + ls*lsMA + t*txMA + sds*model.DeepSleepMA
+		est.DutyCycle = (screen + dark + ls*lsDuty) / period
+		est.AverageMA = charge / period
+	}
+	if batteryMAh > 0 {
+		life := batteryMAh / est.AverageMA * float64(time.Hour)
+		if est.AverageMA <= 0 || life >= math.MaxInt64 {
+			est.Unbounded = true
+		} else {
+			est.Life = time.Duration(life)
+		}
+	}
+	return est
+}
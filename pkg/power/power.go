@@ -0,0 +1,195 @@
+package power
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+)
+
+// NEVER disables a sleep timeout, the firmware does not count down on this value
+const NEVER uint32 = math.MaxUint32
+
+// The values the firmware uses for preferences left at 0
+const (
+	DEFAULT_POSITION_BROADCAST_SECS = 15 * 60
+	DEFAULT_WAIT_BLUETOOTH_SECS     = 60
+	DEFAULT_SCREEN_ON_SECS          = 60
+	DEFAULT_PHONE_SDS_TIMEOUT_SEC   = 2 * 60 * 60
+	DEFAULT_MESH_SDS_TIMEOUT_SECS   = 2 * 60 * 60
+	DEFAULT_SDS_SECS                = 365 * 24 * 60 * 60
+	DEFAULT_LS_SECS                 = 5 * 60
+	DEFAULT_MIN_WAKE_SECS           = 10
+)
+
+// Profile names
+const (
+	ROUTER         = "router"
+	SOLAR_REPEATER = "solar-repeater"
+	TRACKER        = "tracker"
+	HANDHELD       = "handheld"
+)
+
+var ErrUnknownProfile = errors.New("unknown power profile")
+
+// Profile is a consistent set of the sleep related preferences.
+//
+// After ScreenOnSecs the screen goes off, after WaitBluetoothSecs more without a
+// phone the radio starts light sleep: it sleeps LsSecs and stays awake MinWakeSecs,
+// over and over. Packets from the mesh wake it up. Without mesh traffic for
+// MeshSdsTimeoutSecs, or without a phone for PhoneSdsTimeoutSec, it goes to super
+// deep sleep for SdsSecs and stops relaying.
+type Profile struct {
+	Name        string
+	Description string
+
+	ScreenOnSecs       uint32
+	WaitBluetoothSecs  uint32
+	LsSecs             uint32
+	MinWakeSecs        uint32
+	PhoneSdsTimeoutSec uint32
+	MeshSdsTimeoutSecs uint32
+	SdsSecs            uint32
+
+	// Light sleep lasts one position broadcast interval, so positions go out on time
+	lsFollowsPosition bool
+}
+
+// PROFILES are the presets Lookup knows
+var PROFILES = []Profile{
+	{
+		Name:               ROUTER,
+		Description:        "always on, relays everything and keeps bluetooth up, for mains power",
+		ScreenOnSecs:       DEFAULT_SCREEN_ON_SECS,
+		WaitBluetoothSecs:  NEVER,
+		LsSecs:             DEFAULT_LS_SECS,
+		MinWakeSecs:        DEFAULT_MIN_WAKE_SECS,
+		PhoneSdsTimeoutSec: NEVER,
+		MeshSdsTimeoutSecs: NEVER,
+		SdsSecs:            NEVER,
+	},
+	{
+		Name:               HANDHELD,
+		Description:        "firmware defaults, deep sleeps when neither the mesh nor a phone has been heard for 2 hours",
+		ScreenOnSecs:       DEFAULT_SCREEN_ON_SECS,
+		WaitBluetoothSecs:  DEFAULT_WAIT_BLUETOOTH_SECS,
+		LsSecs:             DEFAULT_LS_SECS,
+		MinWakeSecs:        DEFAULT_MIN_WAKE_SECS,
+		PhoneSdsTimeoutSec: DEFAULT_PHONE_SDS_TIMEOUT_SEC,
+		MeshSdsTimeoutSecs: DEFAULT_MESH_SDS_TIMEOUT_SECS,
+		SdsSecs:            DEFAULT_SDS_SECS,
+	},
+	{
+		Name:               SOLAR_REPEATER,
+		Description:        "light sleeps but never deep sleeps, so it keeps relaying, for small solar setups",
+		ScreenOnSecs:       10,
+		WaitBluetoothSecs:  DEFAULT_WAIT_BLUETOOTH_SECS,
+		LsSecs:             DEFAULT_LS_SECS,
+		MinWakeSecs:        DEFAULT_MIN_WAKE_SECS,
+		PhoneSdsTimeoutSec: NEVER,
+		MeshSdsTimeoutSecs: NEVER,
+		SdsSecs:            NEVER,
+	},
+	{
+		Name:               TRACKER,
+		Description:        "sleeps between position broadcasts and never deep sleeps, for unattended trackers",
+		ScreenOnSecs:       5,
+		WaitBluetoothSecs:  15,
+		MinWakeSecs:        DEFAULT_MIN_WAKE_SECS,
+		PhoneSdsTimeoutSec: NEVER,
+		MeshSdsTimeoutSecs: NEVER,
+		SdsSecs:            NEVER,
+		lsFollowsPosition:  true,
+	},
+}
+
+// Lookup returns the profile called name
+func Lookup(name string) (Profile, error) {
+	for _, p := range PROFILES {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return Profile{}, fmt.Errorf("%w: %q", ErrUnknownProfile, name)
+}
+
+// Apply returns a copy of prefs with the sleep preferences of the profile.
+// The other preferences, PositionBroadcastSecs included, are kept.
+func (p Profile) Apply(prefs *message.RadioConfig_UserPreferences) *message.RadioConfig_UserPreferences {
+	res := &message.RadioConfig_UserPreferences{}
+	if prefs != nil {
+		res = proto.Clone(prefs).(*message.RadioConfig_UserPreferences)
+	}
+	res.ScreenOnSecs = p.ScreenOnSecs
+	res.WaitBluetoothSecs = p.WaitBluetoothSecs
+	res.LsSecs = p.LsSecs
+	res.MinWakeSecs = p.MinWakeSecs
+	res.PhoneSdsTimeoutSec = p.PhoneSdsTimeoutSec
+	res.MeshSdsTimeoutSecs = p.MeshSdsTimeoutSecs
+	res.SdsSecs = p.SdsSecs
+	if p.lsFollowsPosition {
+		res.LsSecs = DEFAULT_LS_SECS
+		pos := orDefault(res.PositionBroadcastSecs, DEFAULT_POSITION_BROADCAST_SECS)
+		if pos > p.MinWakeSecs {
+			res.LsSecs = pos - p.MinWakeSecs
+		}
+	}
+	return res
+}
+
+// WithDefaults returns a copy of prefs with the fields left at 0 set to what the firmware uses
+func WithDefaults(prefs *message.RadioConfig_UserPreferences) *message.RadioConfig_UserPreferences {
+	res := &message.RadioConfig_UserPreferences{}
+	if prefs != nil {
+		res = proto.Clone(prefs).(*message.RadioConfig_UserPreferences)
+	}
+	res.PositionBroadcastSecs = orDefault(res.PositionBroadcastSecs, DEFAULT_POSITION_BROADCAST_SECS)
+	res.WaitBluetoothSecs = orDefault(res.WaitBluetoothSecs, DEFAULT_WAIT_BLUETOOTH_SECS)
+	res.ScreenOnSecs = orDefault(res.ScreenOnSecs, DEFAULT_SCREEN_ON_SECS)
+	res.PhoneSdsTimeoutSec = orDefault(res.PhoneSdsTimeoutSec, DEFAULT_PHONE_SDS_TIMEOUT_SEC)
+	res.MeshSdsTimeoutSecs = orDefault(res.MeshSdsTimeoutSecs, DEFAULT_MESH_SDS_TIMEOUT_SECS)
+	res.SdsSecs = orDefault(res.SdsSecs, DEFAULT_SDS_SECS)
+	res.LsSecs = orDefault(res.LsSecs, DEFAULT_LS_SECS)
+	res.MinWakeSecs = orDefault(res.MinWakeSecs, DEFAULT_MIN_WAKE_SECS)
+	return res
+}
+
+func orDefault(v, def uint32) uint32 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// Check returns the problems with how the sleep preferences of prefs interact
+func Check(prefs *message.RadioConfig_UserPreferences) []error {
+	p := WithDefaults(prefs)
+	var errs []error
+	if p.WaitBluetoothSecs != NEVER {
+		if p.MinWakeSecs >= p.LsSecs {
+			errs = append(errs, fmt.Errorf("min_wake_secs %d is not shorter than ls_secs %d, light sleep saves little", p.MinWakeSecs, p.LsSecs))
+		}
+		if cycle := p.LsSecs + p.MinWakeSecs; cycle > p.PositionBroadcastSecs {
+			errs = append(errs, fmt.Errorf("a light sleep cycle of %ds is longer than position_broadcast_secs %d, positions go out every %ds", cycle, p.PositionBroadcastSecs, cycle))
+		}
+	}
+	awake := uint64(p.ScreenOnSecs) + uint64(p.WaitBluetoothSecs)
+	if t := sdsTimeout(p); t != NEVER && uint64(t) < awake {
+		errs = append(errs, fmt.Errorf("super deep sleep after %ds starts before light sleep would after %ds", t, awake))
+	}
+	if sdsTimeout(p) != NEVER && p.SdsSecs == NEVER {
+		errs = append(errs, errors.New("sds_secs never ends super deep sleep, only a button press wakes the radio"))
+	}
+	return errs
+}
+
+// sdsTimeout is how long an idle radio waits before super deep sleep
+func sdsTimeout(p *message.RadioConfig_UserPreferences) uint32 {
+	if p.PhoneSdsTimeoutSec < p.MeshSdsTimeoutSecs {
+		return p.PhoneSdsTimeoutSec
+	}
+	return p.MeshSdsTimeoutSecs
+}
@@ -0,0 +1,148 @@
+package power
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestPower(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Power Suite")
+}
+
+// A board that only draws while awake makes the numbers easy to check
+var simpleModel = Model{AwakeMA: 100, DeepSleepMA: 1}
+
+var _ = Describe("power", func() {
+	Context("profiles", func() {
+		It("should look profiles up by name", func() {
+			p, err := Lookup(TRACKER)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(p.Name).Should(Equal(TRACKER))
+			_, err = Lookup("toaster")
+			Expect(err).Should(MatchError(ErrUnknownProfile))
+		})
+		It("should only set the sleep preferences", func() {
+			prefs := &message.RadioConfig_UserPreferences{PositionBroadcastSecs: 600, WifiSsid: "net", LsSecs: 1}
+			p, _ := Lookup(SOLAR_REPEATER)
+			res := p.Apply(prefs)
+			Expect(res.GetPositionBroadcastSecs()).Should(BeEquivalentTo(600))
+			Expect(res.GetWifiSsid()).Should(Equal("net"))
+			Expect(res.GetLsSecs()).Should(BeEquivalentTo(DEFAULT_LS_SECS))
+			Expect(res.GetMeshSdsTimeoutSecs()).Should(Equal(NEVER))
+			Expect(prefs.GetLsSecs()).Should(BeEquivalentTo(1))
+		})
+		It("should sleep trackers for one position interval", func() {
+			p, _ := Lookup(TRACKER)
+			res := p.Apply(&message.RadioConfig_UserPreferences{PositionBroadcastSecs: 120})
+			Expect(res.GetLsSecs() + res.GetMinWakeSecs()).Should(BeEquivalentTo(120))
+			res = p.Apply(nil)
+			Expect(res.GetLsSecs() + res.GetMinWakeSecs()).Should(BeEquivalentTo(DEFAULT_POSITION_BROADCAST_SECS))
+		})
+		It("should produce consistent preferences", func() {
+			for _, p := range PROFILES {
+				for _, pos := range []uint32{0, 60, 600, 3600} {
+					prefs := p.Apply(&message.RadioConfig_UserPreferences{PositionBroadcastSecs: pos})
+					if pos == 60 && p.Name != TRACKER && p.Name != ROUTER {
+						// Light sleep is longer than the position interval
+						Expect(Check(prefs)).Should(HaveLen(1), p.Name)
+						continue
+					}
+					Expect(Check(prefs)).Should(BeEmpty(), "%s %d", p.Name, pos)
+				}
+			}
+		})
+	})
+	Context("check", func() {
+		It("should accept the firmware defaults", func() {
+			Expect(Check(nil)).Should(BeEmpty())
+		})
+		It("should find sleep settings that work against each other", func() {
+			errs := Check(&message.RadioConfig_UserPreferences{
+				LsSecs:                5,
+				MinWakeSecs:           30,
+				PositionBroadcastSecs: 20,
+				MeshSdsTimeoutSecs:    30,
+				SdsSecs:               NEVER,
+			})
+			Expect(errs).Should(HaveLen(4))
+		})
+		It("should fill in defaults without changing prefs", func() {
+			prefs := &message.RadioConfig_UserPreferences{ScreenOnSecs: 5}
+			res := WithDefaults(prefs)
+			Expect(res.GetScreenOnSecs()).Should(BeEquivalentTo(5))
+			Expect(res.GetSdsSecs()).Should(BeEquivalentTo(DEFAULT_SDS_SECS))
+			Expect(proto.Equal(prefs, &message.RadioConfig_UserPreferences{ScreenOnSecs: 5})).Should(BeTrue())
+		})
+	})
+	Context("estimate", func() {
+		It("should keep always on radios awake", func() {
+			p, _ := Lookup(ROUTER)
+			est := EstimateLife(p.Apply(nil), simpleModel, 2400)
+			Expect(est.DutyCycle).Should(BeEquivalentTo(1))
+			Expect(est.AverageMA).Should(BeEquivalentTo(100))
+			Expect(est.PositionSecs).Should(BeEquivalentTo(DEFAULT_POSITION_BROADCAST_SECS))
+			Expect(est.DeepSleep).Should(BeFalse())
+			Expect(est.Life).Should(Equal(24 * time.Hour))
+		})
+		It("should delay positions to the light sleep wake ups", func() {
+			prefs := &message.RadioConfig_UserPreferences{
+				PositionBroadcastSecs: 100,
+				LsSecs:                90,
+				MinWakeSecs:           10,
+				PhoneSdsTimeoutSec:    NEVER,
+				MeshSdsTimeoutSecs:    NEVER,
+			}
+			est := EstimateLife(prefs, simpleModel, 0)
+			Expect(est.DutyCycle).Should(BeNumerically("~", 0.1))
+			Expect(est.AverageMA).Should(BeNumerically("~", 10))
+			Expect(est.Life).Should(BeZero())
+
+			prefs.PositionBroadcastSecs = 150
+			Expect(EstimateLife(prefs, simpleModel, 0).PositionSecs).Should(BeEquivalentTo(200))
+		})
+		It("should count transmissions", func() {
+			p, _ := Lookup(ROUTER)
+			prefs := p.Apply(&message.RadioConfig_UserPreferences{PositionBroadcastSecs: 100})
+			est := EstimateLife(prefs, Model{AwakeMA: 10, TxMA: 100, TxSecs: 2}, 0)
+			Expect(est.AverageMA).Should(BeNumerically("~", 12))
+		})
+		It("should include super deep sleep", func() {
+			prefs := &message.RadioConfig_UserPreferences{
+				ScreenOnSecs:       100,
+				WaitBluetoothSecs:  100,
+				LsSecs:             90,
+				MinWakeSecs:        10,
+				MeshSdsTimeoutSecs: 1200,
+				SdsSecs:            800,
+			}
+			est := EstimateLife(prefs, simpleModel, 0)
+			Expect(est.DeepSleep).Should(BeTrue())
+			// 200s awake, 1000s light sleeping at 10%, 800s deep sleep
+			Expect(est.DutyCycle).Should(BeNumerically("~", 0.15))
+			Expect(est.AverageMA).Should(BeNumerically("~", (200*100+1000*10+800*1)/2000.0))
+
+			prefs.SdsSecs = NEVER
+			est = EstimateLife(prefs, simpleModel, 0)
+			Expect(est.DutyCycle).Should(BeZero())
+			Expect(est.AverageMA).Should(BeEquivalentTo(1))
+		})
+		It("should not overflow when nothing is drawn", func() {
+			prefs := &message.RadioConfig_UserPreferences{MeshSdsTimeoutSecs: 60, SdsSecs: NEVER}
+			est := EstimateLife(prefs, Model{}, 2400)
+			Expect(est.Unbounded).Should(BeTrue())
+			Expect(est.Life).Should(BeZero())
+
+			est = EstimateLife(prefs, Model{DeepSleepMA: 1e-12}, 2400)
+			Expect(est.Unbounded).Should(BeTrue())
+			Expect(EstimateLife(prefs, simpleModel, 2400).Unbounded).Should(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,506 @@
+package provision
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long a radio gets to send its config back after the writes
+	VERIFY_TIMEOUT = 10 * time.Second
+	// Reports name the radio, they are not secret, the PSK is left out
+	REPORT_FILE_MODE = 0644
+)
+
+// Status is the outcome of provisioning one radio
+type Status string
+
+const (
+	STATUS_OK            Status = "ok"
+	STATUS_UNMATCHED     Status = "unmatched"     // no manifest entry for the radio, nothing was written
+	STATUS_FAILED        Status = "failed"        // could not connect or write
+	STATUS_VERIFY_FAILED Status = "verify_failed" // the radio did not report what was written
+)
+
+var ErrNoIdentity = errors.New("manifest entry needs node_num or macaddr")
+
+// Entry is what one radio is set to. The fields of Channel and Preferences named
+// in ChannelFields and PreferenceFields replace those of the radio's current
+// config, repeated fields included. The others are not changed.
+type Entry struct {
+	NodeNum     uint32
+	Macaddr     string // aa:bb:cc:dd:ee:ff
+	LongName    string
+	ShortName   string
+	Channel     *message.ChannelSettings
+	Preferences *message.RadioConfig_UserPreferences
+	// Proto field names. UnmarshalJSON lists the keys present in the manifest, so
+	// a field can be set back to 0 or false. When nil, the fields that are not at
+	// their zero value are written.
+	ChannelFields    []string
+	PreferenceFields []string
+}
+
+// entryJSON is Entry on disk, the protobuf parts use the protojson field names
+type entryJSON struct {
+	NodeNum     uint32          `json:"node_num,omitempty"`
+	Macaddr     string          `json:"macaddr,omitempty"`
+	LongName    string          `json:"long_name,omitempty"`
+	ShortName   string          `json:"short_name,omitempty"`
+	Channel     json.RawMessage `json:"channel,omitempty"`
+	Preferences json.RawMessage `json:"preferences,omitempty"`
+}
+
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	ej := entryJSON{}
+	err := json.Unmarshal(data, &ej)
+	if err != nil {
+		return err
+	}
+	*e = Entry{
+		NodeNum:   ej.NodeNum,
+		Macaddr:   ej.Macaddr,
+		LongName:  ej.LongName,
+		ShortName: ej.ShortName,
+	}
+	if len(ej.Channel) > 0 {
+		e.Channel = &message.ChannelSettings{}
+		err = protojson.Unmarshal(ej.Channel, e.Channel)
+		if err != nil {
+			return fmt.Errorf("channel: %w", err)
+		}
+		e.ChannelFields, err = presentFields(ej.Channel, e.Channel)
+		if err != nil {
+			return fmt.Errorf("channel: %w", err)
+		}
+	}
+	if len(ej.Preferences) > 0 {
+		e.Preferences = &message.RadioConfig_UserPreferences{}
+		err = protojson.Unmarshal(ej.Preferences, e.Preferences)
+		if err != nil {
+			return fmt.Errorf("preferences: %w", err)
+		}
+		e.PreferenceFields, err = presentFields(ej.Preferences, e.Preferences)
+		if err != nil {
+			return fmt.Errorf("preferences: %w", err)
+		}
+	}
+	return nil
+}
+
+// presentFields returns the proto names of the keys in data, a protojson object of msg
+func presentFields(data []byte, msg proto.Message) ([]string, error) {
+	keys := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, err
+	}
+	fields := msg.ProtoReflect().Descriptor().Fields()
+	res := []string{}
+	for k := range keys {
+		fd := fields.ByJSONName(k)
+		if fd == nil {
+			fd = fields.ByName(protoreflect.Name(k))
+		}
+		// protojson already rejected unknown keys
+		if fd != nil {
+			res = append(res, string(fd.Name()))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Manifest maps radios to their settings. Defaults apply to every matched radio,
+// a device entry overrides them field by field.
+type Manifest struct {
+	Defaults Entry   `json:"defaults"`
+	Devices  []Entry `json:"devices"`
+}
+
+// LoadManifest reads a JSON manifest, see ParseManifest
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(data)
+}
+
+// ParseManifest checks every device entry names a radio, and names it only once
+func ParseManifest(data []byte) (*Manifest, error) {
+	man := &Manifest{}
+	err := json.Unmarshal(data, man)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i, e := range man.Devices {
+		if e.NodeNum == 0 && e.Macaddr == "" {
+			return nil, fmt.Errorf("device %d: %w", i, ErrNoIdentity)
+		}
+		keys := []string{}
+		if e.NodeNum != 0 {
+			keys = append(keys, fmt.Sprintf("!%08x", e.NodeNum))
+		}
+		if e.Macaddr != "" {
+			mac, err := parseMac(e.Macaddr)
+			if err != nil {
+				return nil, fmt.Errorf("device %d: %w", i, err)
+			}
+			keys = append(keys, formatMac(mac))
+		}
+		for _, k := range keys {
+			if seen[k] {
+				return nil, fmt.Errorf("device %d: %s is listed twice", i, k)
+			}
+			seen[k] = true
+		}
+	}
+	return man, nil
+}
+
+// Match returns the entry for a radio merged over the defaults, or nil if none names it
+func (man *Manifest) Match(nodeNum uint32, mac []byte) *Entry {
+	for _, e := range man.Devices {
+		if e.NodeNum != 0 && e.NodeNum == nodeNum {
+			return man.merge(e)
+		}
+		if e.Macaddr != "" && len(mac) > 0 {
+			m, err := parseMac(e.Macaddr)
+			if err == nil && string(m) == string(mac) {
+				return man.merge(e)
+			}
+		}
+	}
+	return nil
+}
+
+func (man *Manifest) merge(e Entry) *Entry {
+	res := e
+	if res.LongName == "" {
+		res.LongName = man.Defaults.LongName
+	}
+	if res.ShortName == "" {
+		res.ShortName = man.Defaults.ShortName
+	}
+	var msg proto.Message
+	msg, res.ChannelFields = mergeFields(man.Defaults.Channel, man.Defaults.ChannelFields, e.Channel, e.ChannelFields)
+	res.Channel = msg.(*message.ChannelSettings)
+	msg, res.PreferenceFields = mergeFields(man.Defaults.Preferences, man.Defaults.PreferenceFields, e.Preferences, e.PreferenceFields)
+	res.Preferences = msg.(*message.RadioConfig_UserPreferences)
+	return &res
+}
+
+// mergeFields returns base with the fields of over applied and the fields of both,
+// over itself if base is nil
+func mergeFields(base proto.Message, baseFields []string, over proto.Message, overFields []string) (proto.Message, []string) {
+	if !base.ProtoReflect().IsValid() {
+		return over, overFields
+	}
+	res := base.ProtoReflect().New().Interface()
+	baseFields = fieldsOf(base, baseFields)
+	overFields = fieldsOf(over, overFields)
+	overlay(res, base, baseFields)
+	overlay(res, over, overFields)
+	seen := make(map[string]bool)
+	fields := []string{}
+	for _, f := range append(baseFields, overFields...) {
+		if !seen[f] {
+			seen[f] = true
+			fields = append(fields, f)
+		}
+	}
+	sort.Strings(fields)
+	return res, fields
+}
+
+// fieldsOf returns names, or the fields msg sets when names is nil
+func fieldsOf(msg proto.Message, names []string) []string {
+	if names != nil || !msg.ProtoReflect().IsValid() {
+		return names
+	}
+	res := []string{}
+	msg.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		res = append(res, string(fd.Name()))
+		return true
+	})
+	return res
+}
+
+// overlay sets the named fields of dst to those of src. Repeated fields are
+// replaced instead of appended to, fields src leaves at zero are cleared.
+func overlay(dst, src proto.Message, names []string) {
+	d := dst.ProtoReflect()
+	s := proto.Clone(src).ProtoReflect()
+	fields := d.Descriptor().Fields()
+	for _, n := range names {
+		fd := fields.ByName(protoreflect.Name(n))
+		if fd == nil {
+			continue
+		}
+		if s.IsValid() && s.Has(fd) {
+			d.Set(fd, s.Get(fd))
+		} else {
+			d.Clear(fd)
+		}
+	}
+}
+
+func parseMac(s string) ([]byte, error) {
+	mac, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid macaddr %q", s)
+	}
+	return mac, nil
+}
+
+func formatMac(mac []byte) string {
+	parts := make([]string, len(mac))
+	for i, b := range mac {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Target is a radio to provision, Open returns a Mesh that has not connected yet
+type Target struct {
+	Path string
+	Open func() (*mesh.Mesh, error)
+}
+
+// SerialTargets opens each path as a serial radio with opts, e.g. from mesh.Discover
+func SerialTargets(paths []string, opts ...mesh.Option) []Target {
+	targets := make([]Target, len(paths))
+	for i, p := range paths {
+		p := p
+		targets[i] = Target{Path: p, Open: func() (*mesh.Mesh, error) {
+			return mesh.NewMesh(p, mesh.TRANSPORT_SERIAL, opts...)
+		}}
+	}
+	return targets
+}
+
+// Report is what happened to one radio
+type Report struct {
+	Path       string        `json:"path"`
+	NodeNum    uint32        `json:"node_num,omitempty"`
+	Macaddr    string        `json:"macaddr,omitempty"`
+	LongName   string        `json:"long_name,omitempty"`
+	Status     Status        `json:"status"`
+	Error      string        `json:"error,omitempty"`
+	Mismatches []string      `json:"mismatches,omitempty"` // fields the radio reported differently after the writes
+	Started    time.Time     `json:"started"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Option configures Provision
+type Option func(*provisioner)
+
+// WithLogger sends logs to l instead of the logrus standard logger
+func WithLogger(l log.FieldLogger) Option {
+	return func(p *provisioner) {
+		p.logger = l
+	}
+}
+
+// WithVerifyTimeout sets how long a radio gets to send its config back, VERIFY_TIMEOUT by default
+func WithVerifyTimeout(d time.Duration) Option {
+	return func(p *provisioner) {
+		p.verifyTimeout = d
+	}
+}
+
+type provisioner struct {
+	man           *Manifest
+	logger        log.FieldLogger
+	verifyTimeout time.Duration
+}
+
+// Provision configures every target in parallel and returns a report for each, in the order of targets
+func Provision(man *Manifest, targets []Target, opts ...Option) []Report {
+	p := &provisioner{
+		man:           man,
+		logger:        log.StandardLogger(),
+		verifyTimeout: VERIFY_TIMEOUT,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.logger = p.logger.WithField(mt.FIELD_COMPONENT, "provision")
+
+	reports := make([]Report, len(targets))
+	wg := &sync.WaitGroup{}
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer wg.Done()
+			reports[i] = p.provision(t)
+		}(i, t)
+	}
+	wg.Wait()
+	return reports
+}
+
+func (p *provisioner) provision(t Target) Report {
+	rep := Report{Path: t.Path, Started: time.Now()}
+	logger := p.logger.WithField(mt.FIELD_PATH, t.Path)
+	defer func() {
+		rep.Duration = time.Since(rep.Started)
+		logger.WithField("status", rep.Status).Info("radio done")
+	}()
+	fail := func(err error) Report {
+		logger.WithError(err).Error("could not provision radio")
+		rep.Status = STATUS_FAILED
+		rep.Error = err.Error()
+		return rep
+	}
+
+	m, err := t.Open()
+	if err != nil {
+		return fail(err)
+	}
+	// A failed Connect closes the mesh itself
+	err = m.Connect()
+	if err != nil {
+		return fail(err)
+	}
+	defer m.Close()
+
+	rep.NodeNum = m.GetMyNodeInfo().GetMyNodeNum()
+	mac := m.GetOwner().GetMacaddr()
+	if len(mac) > 0 {
+		rep.Macaddr = formatMac(mac)
+	}
+	logger = logger.WithField(mt.FIELD_NODE, fmt.Sprintf("!%08x", rep.NodeNum))
+	e := p.man.Match(rep.NodeNum, mac)
+	if e == nil {
+		logger.Warn("radio is not in the manifest")
+		rep.Status = STATUS_UNMATCHED
+		return rep
+	}
+	rep.LongName = e.LongName
+
+	want := apply(m.GetRadioConfig(), e)
+	logger.Info("writing radio config")
+	err = m.SetRadioConfig(want)
+	if err != nil {
+		return fail(err)
+	}
+	if e.LongName != "" || e.ShortName != "" {
+		err = m.SetOwner(&message.User{LongName: e.LongName, ShortName: e.ShortName})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	err = m.RequestConfig(p.verifyTimeout)
+	if err != nil {
+		return fail(err)
+	}
+	rep.Mismatches = verify(want, m.GetRadioConfig(), e, m.GetOwner())
+	if len(rep.Mismatches) > 0 {
+		logger.WithField("mismatches", rep.Mismatches).Error("radio did not take the config")
+		rep.Status = STATUS_VERIFY_FAILED
+		return rep
+	}
+	rep.Status = STATUS_OK
+	return rep
+}
+
+// apply returns a copy of cur with the channel and preferences fields of e set
+func apply(cur *message.RadioConfig, e *Entry) *message.RadioConfig {
+	want := &message.RadioConfig{}
+	if cur != nil {
+		want = proto.Clone(cur).(*message.RadioConfig)
+	}
+	if e.Channel != nil || e.ChannelFields != nil {
+		if want.ChannelSettings == nil {
+			want.ChannelSettings = &message.ChannelSettings{}
+		}
+		overlay(want.ChannelSettings, e.Channel, fieldsOf(e.Channel, e.ChannelFields))
+	}
+	if e.Preferences != nil || e.PreferenceFields != nil {
+		if want.Preferences == nil {
+			want.Preferences = &message.RadioConfig_UserPreferences{}
+		}
+		overlay(want.Preferences, e.Preferences, fieldsOf(e.Preferences, e.PreferenceFields))
+	}
+	return want
+}
+
+// verify lists the fields where the radio reports something other than what was written
+func verify(want, got *message.RadioConfig, e *Entry, owner *message.User) []string {
+	res := diff("channel.", want.GetChannelSettings(), got.GetChannelSettings())
+	res = append(res, diff("preferences.", want.GetPreferences(), got.GetPreferences())...)
+	if e.LongName != "" && owner.GetLongName() != e.LongName {
+		res = append(res, "owner.long_name")
+	}
+	if e.ShortName != "" && owner.GetShortName() != e.ShortName {
+		res = append(res, "owner.short_name")
+	}
+	return res
+}
+
+// diff compares want and got one field at a time, got may be nil
+func diff(prefix string, want, got proto.Message) []string {
+	res := []string{}
+	w, g := want.ProtoReflect(), got.ProtoReflect()
+	fields := w.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		a, b := w.Type().New(), w.Type().New()
+		if w.Has(fd) {
+			a.Set(fd, w.Get(fd))
+		}
+		if g.IsValid() && g.Has(fd) {
+			b.Set(fd, g.Get(fd))
+		}
+		if !proto.Equal(a.Interface(), b.Interface()) {
+			res = append(res, prefix+string(fd.Name()))
+		}
+	}
+	return res
+}
+
+// WriteReports writes each report to dir as JSON, named after the radio's node number
+// or, for radios that could not be read, its path
+func WriteReports(dir string, reports []Report) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, r := range reports {
+		name := filepath.Base(r.Path)
+		if r.NodeNum != 0 {
+			name = fmt.Sprintf("%08x", r.NodeNum)
+		}
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, name+".json"), append(data, '\n'), REPORT_FILE_MODE)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
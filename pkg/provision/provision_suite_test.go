@@ -0,0 +1,264 @@
+package provision
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestProvision(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Provision Suite")
+}
+
+var logger = func() *log.Logger {
+	l := log.New()
+	l.SetLevel(log.DebugLevel)
+	return l
+}()
+
+// simRadio is a transport that answers like a radio, keeping what is written to it
+type simRadio struct {
+	mu       sync.Mutex
+	rxCh     chan []byte
+	num      uint32
+	mac      []byte
+	owner    *message.User
+	radio    *message.RadioConfig
+	readOnly bool // drop writes, like a radio that rejects them
+	silent   bool // never answer, like a port without a radio
+	closes   int
+}
+
+func newSimRadio(num uint32, mac []byte) *simRadio {
+	return &simRadio{
+		num:   num,
+		mac:   mac,
+		owner: &message.User{Id: "!sim", LongName: "Unnamed", ShortName: "U", Macaddr: mac},
+		radio: &message.RadioConfig{
+			Preferences:     &message.RadioConfig_UserPreferences{PositionBroadcastSecs: 900, WaitBluetoothSecs: 120},
+			ChannelSettings: &message.ChannelSettings{Name: "Default", ModemConfig: message.ChannelSettings_Bw125Cr45Sf128},
+		},
+	}
+}
+
+func (s *simRadio) target(path string) Target {
+	return Target{Path: path, Open: func() (*mesh.Mesh, error) {
+		return mesh.NewMeshWithTransport(func(rxCh chan []byte, mu *sync.Mutex) mt.TransportInterface {
+			s.rxCh = rxCh
+			return s
+		}, mesh.WithLogger(logger), mesh.WithConfigTimeout(time.Second)), nil
+	}}
+}
+
+func (s *simRadio) send(msg *message.FromRadio) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		logger.WithError(err).Fatal("error creating pb")
+	}
+	s.rxCh <- data
+}
+
+func (s *simRadio) Connect() error { return nil }
+func (s *simRadio) Listen()        {}
+func (s *simRadio) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closes++
+}
+
+func (s *simRadio) SendToRadio(data []byte) error {
+	msg := &message.ToRadio{}
+	err := proto.Unmarshal(data, msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.silent {
+		return nil
+	}
+	switch v := msg.Variant.(type) {
+	case *message.ToRadio_WantConfigId:
+		s.send(&message.FromRadio{Variant: &message.FromRadio_MyInfo{MyInfo: &message.MyNodeInfo{
+			MyNodeNum: s.num, FirmwareVersion: "0.9.1",
+		}}})
+		s.send(&message.FromRadio{Variant: &message.FromRadio_Radio{Radio: proto.Clone(s.radio).(*message.RadioConfig)}})
+		s.send(&message.FromRadio{Variant: &message.FromRadio_NodeInfo{NodeInfo: &message.NodeInfo{
+			Num: s.num, User: proto.Clone(s.owner).(*message.User),
+		}}})
+		s.send(&message.FromRadio{Variant: &message.FromRadio_ConfigCompleteId{ConfigCompleteId: v.WantConfigId}})
+	case *message.ToRadio_SetRadio:
+		if !s.readOnly {
+			s.radio = v.SetRadio
+		}
+	case *message.ToRadio_SetOwner:
+		if !s.readOnly {
+			s.owner.LongName = v.SetOwner.LongName
+			s.owner.ShortName = v.SetOwner.ShortName
+		}
+	}
+	return nil
+}
+
+const manifest = `{
+	"defaults": {
+		"channel": {"name": "Fleet", "psk": "AQIDBA==", "modemConfig": "Bw500Cr45Sf128"},
+		"preferences": {"ls_secs": 300}
+	},
+	"devices": [
+		{"node_num": 1001, "long_name": "Truck 1", "short_name": "T1", "preferences": {"ls_secs": 60}},
+		{"macaddr": "AA:BB:CC:00:00:02", "long_name": "Truck 2", "short_name": "T2"}
+	]
+}`
+
+var _ = Describe("provision", func() {
+	var man *Manifest
+	BeforeEach(func() {
+		var err error
+		man, err = ParseManifest([]byte(manifest))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	Context("manifest", func() {
+		It("should merge device entries over the defaults", func() {
+			e := man.Match(1001, nil)
+			Expect(e.LongName).Should(Equal("Truck 1"))
+			Expect(e.Channel.GetName()).Should(Equal("Fleet"))
+			Expect(e.Channel.GetPsk()).Should(Equal([]byte{1, 2, 3, 4}))
+			Expect(e.Preferences.GetLsSecs()).Should(BeEquivalentTo(60))
+			Expect(man.Defaults.Preferences.GetLsSecs()).Should(BeEquivalentTo(300))
+		})
+		It("should replace lists and write explicit zero values", func() {
+			man, err := ParseManifest([]byte(`{
+				"defaults": {"preferences": {"ignore_incoming": [1, 2], "lsSecs": 300, "wifi_ap_mode": true}},
+				"devices": [{"node_num": 5, "preferences": {"ignoreIncoming": [3], "wifi_ap_mode": false}}]
+			}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			e := man.Match(5, nil)
+			Expect(e.PreferenceFields).Should(Equal([]string{"ignore_incoming", "ls_secs", "wifi_ap_mode"}))
+			cur := &message.RadioConfig{Preferences: &message.RadioConfig_UserPreferences{
+				IgnoreIncoming: []uint32{3, 4}, LsSecs: 60, WifiApMode: true, ScreenOnSecs: 30,
+			}}
+			want := apply(cur, e)
+			Expect(proto.Equal(want.GetPreferences(), &message.RadioConfig_UserPreferences{
+				IgnoreIncoming: []uint32{3}, LsSecs: 300, ScreenOnSecs: 30,
+			})).Should(BeTrue(), want.GetPreferences().String())
+			// Provisioning again changes nothing
+			Expect(proto.Equal(apply(want, e), want)).Should(BeTrue())
+			Expect(cur.GetPreferences().GetIgnoreIncoming()).Should(Equal([]uint32{3, 4}))
+		})
+		It("should write the set fields of entries built in code", func() {
+			e := &Entry{Preferences: &message.RadioConfig_UserPreferences{IgnoreIncoming: []uint32{7}}}
+			want := apply(&message.RadioConfig{Preferences: &message.RadioConfig_UserPreferences{IgnoreIncoming: []uint32{7}, LsSecs: 60}}, e)
+			Expect(want.GetPreferences().GetIgnoreIncoming()).Should(Equal([]uint32{7}))
+			Expect(want.GetPreferences().GetLsSecs()).Should(BeEquivalentTo(60))
+		})
+		It("should match by mac address", func() {
+			Expect(man.Match(7, []byte{0xaa, 0xbb, 0xcc, 0, 0, 2}).ShortName).Should(Equal("T2"))
+			Expect(man.Match(7, []byte{0xaa, 0xbb, 0xcc, 0, 0, 3})).Should(BeNil())
+		})
+		It("should reject entries without identity", func() {
+			_, err := ParseManifest([]byte(`{"devices": [{"long_name": "x"}]}`))
+			Expect(err).Should(MatchError(ErrNoIdentity))
+		})
+		It("should reject duplicates", func() {
+			_, err := ParseManifest([]byte(`{"devices": [{"macaddr": "aa:bb"}, {"macaddr": "AA-BB"}]}`))
+			Expect(err).Should(MatchError(ContainSubstring("aa:bb is listed twice")))
+		})
+		It("should reject invalid settings", func() {
+			_, err := ParseManifest([]byte(`{"devices": [{"node_num": 1, "channel": {"bogus": 1}}]}`))
+			Expect(err).Should(MatchError(ContainSubstring("channel:")))
+		})
+	})
+	Context("Provision", func() {
+		var r1, r2, r3 *simRadio
+		BeforeEach(func() {
+			r1 = newSimRadio(1001, []byte{0xaa, 0xbb, 0xcc, 0, 0, 1})
+			r2 = newSimRadio(1002, []byte{0xaa, 0xbb, 0xcc, 0, 0, 2})
+			r3 = newSimRadio(1003, []byte{0xaa, 0xbb, 0xcc, 0, 0, 3})
+		})
+		It("should configure every radio in the manifest", func() {
+			reps := Provision(man, []Target{r1.target("/dev/ttyUSB0"), r2.target("/dev/ttyUSB1"), r3.target("/dev/ttyUSB2")},
+				WithLogger(logger), WithVerifyTimeout(time.Second))
+			Expect(reps).Should(HaveLen(3))
+			Expect(reps[0].Status).Should(Equal(STATUS_OK))
+			Expect(reps[0].NodeNum).Should(BeEquivalentTo(1001))
+			Expect(reps[1].Status).Should(Equal(STATUS_OK))
+			Expect(reps[1].Macaddr).Should(Equal("aa:bb:cc:00:00:02"))
+			Expect(reps[2].Status).Should(Equal(STATUS_UNMATCHED))
+
+			Expect(r1.owner.LongName).Should(Equal("Truck 1"))
+			Expect(r1.radio.Preferences.LsSecs).Should(BeEquivalentTo(60))
+			Expect(r2.radio.Preferences.LsSecs).Should(BeEquivalentTo(300))
+			Expect(r2.radio.ChannelSettings.Name).Should(Equal("Fleet"))
+			Expect(r2.radio.ChannelSettings.ModemConfig).Should(Equal(message.ChannelSettings_Bw500Cr45Sf128))
+			// Settings not in the manifest are kept
+			Expect(r2.radio.Preferences.PositionBroadcastSecs).Should(BeEquivalentTo(900))
+			Expect(r2.radio.Preferences.WaitBluetoothSecs).Should(BeEquivalentTo(120))
+			Expect(r3.owner.LongName).Should(Equal("Unnamed"))
+			Expect(r3.radio.ChannelSettings.Name).Should(Equal("Default"))
+		})
+		It("should report radios that do not take the config", func() {
+			r1.readOnly = true
+			reps := Provision(man, []Target{r1.target("/dev/ttyUSB0")}, WithLogger(logger), WithVerifyTimeout(time.Second))
+			Expect(reps[0].Status).Should(Equal(STATUS_VERIFY_FAILED))
+			Expect(reps[0].Mismatches).Should(ConsistOf(
+				"channel.psk", "channel.modem_config", "channel.name", "preferences.ls_secs",
+				"owner.long_name", "owner.short_name",
+			))
+		})
+		It("should close radios that do not answer once", func() {
+			r1.silent = true
+			t := Target{Path: "/dev/ttyUSB0", Open: func() (*mesh.Mesh, error) {
+				return mesh.NewMeshWithTransport(func(rxCh chan []byte, mu *sync.Mutex) mt.TransportInterface {
+					return r1
+				}, mesh.WithLogger(logger), mesh.WithConfigTimeout(10*time.Millisecond)), nil
+			}}
+			reps := Provision(man, []Target{t}, WithLogger(logger))
+			Expect(reps[0].Status).Should(Equal(STATUS_FAILED))
+			Expect(reps[0].Error).Should(Equal(mesh.ErrConfigTimeout.Error()))
+			Expect(r1.closes).Should(Equal(1))
+		})
+		It("should report radios it cannot open", func() {
+			t := Target{Path: "/dev/ttyUSB9", Open: func() (*mesh.Mesh, error) {
+				return nil, os.ErrNotExist
+			}}
+			reps := Provision(man, []Target{t}, WithLogger(logger))
+			Expect(reps[0].Status).Should(Equal(STATUS_FAILED))
+			Expect(reps[0].Error).Should(Equal(os.ErrNotExist.Error()))
+		})
+	})
+	Context("WriteReports", func() {
+		It("should write a file per radio", func() {
+			dir, err := ioutil.TempDir("", "provision")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			reps := []Report{
+				{Path: "/dev/ttyUSB0", NodeNum: 0x3e9, Status: STATUS_OK},
+				{Path: "/dev/ttyUSB1", Status: STATUS_FAILED, Error: "boom"},
+			}
+			Expect(WriteReports(dir, reps)).Should(Succeed())
+			data, err := ioutil.ReadFile(filepath.Join(dir, "000003e9.json"))
+			Expect(err).ShouldNot(HaveOccurred())
+			got := Report{}
+			Expect(json.Unmarshal(data, &got)).Should(Succeed())
+			Expect(got.Status).Should(Equal(STATUS_OK))
+			_, err = os.Stat(filepath.Join(dir, "ttyUSB1.json"))
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,105 @@
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	SYSFS_TTY = "sys/class/tty"
+	DEV_BY_ID = "dev/serial/by-id"
+	DEV       = "dev"
+
+	// How far up from a tty device to look for the USB idVendor/idProduct
+	USB_PARENT_DEPTH = 4
+)
+
+// KNOWN_USB_IDS maps VID:PID of USB serial bridges used on Meshtastic boards to a name
+var KNOWN_USB_IDS = map[string]string{
+	"10c4:ea60": "CP210x",   // Silicon Labs, TTGO T-Beam, Heltec
+	"1a86:7523": "CH340",    // WCH, TTGO LoRa32
+	"1a86:55d4": "CH9102",   // WCH, newer T-Beams
+	"303a:0002": "ESP32-S2", // Espressif native USB
+}
+
+// Candidate is a serial device with a USB bridge known to be used by Meshtastic boards
+type Candidate struct {
+	Path   string // /dev/serial/by-id link if there is one, otherwise /dev/ttyX
+	Tty    string // e.g. ttyUSB0
+	UsbId  string // VID:PID
+	Bridge string // from KNOWN_USB_IDS
+}
+
+// Candidates walks the sysfs tty entries under root ("/" on a live system) and
+// returns the serial devices whose USB VID:PID is in KNOWN_USB_IDS, ordered by tty name.
+func Candidates(root string) ([]Candidate, error) {
+	ttys, err := ioutil.ReadDir(filepath.Join(root, SYSFS_TTY))
+	if err != nil {
+		return nil, err
+	}
+	byID := byIDLinks(root)
+
+	res := make([]Candidate, 0)
+	for _, tty := range ttys {
+		id := usbID(filepath.Join(root, SYSFS_TTY, tty.Name(), "device"))
+		bridge, ok := KNOWN_USB_IDS[id]
+		if !ok {
+			continue
+		}
+		c := Candidate{
+			Path:   filepath.Join(root, DEV, tty.Name()),
+			Tty:    tty.Name(),
+			UsbId:  id,
+			Bridge: bridge,
+		}
+		if link, ok := byID[tty.Name()]; ok {
+			c.Path = link
+		}
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Tty < res[j].Tty })
+	return res, nil
+}
+
+// byIDLinks maps tty names to their stable /dev/serial/by-id link
+func byIDLinks(root string) map[string]string {
+	res := make(map[string]string)
+	dir := filepath.Join(root, DEV_BY_ID)
+	links, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return res
+	}
+	for _, l := range links {
+		path := filepath.Join(dir, l.Name())
+		target, err := os.Readlink(path)
+		if err != nil {
+			continue
+		}
+		res[filepath.Base(target)] = path
+	}
+	return res
+}
+
+// usbID finds idVendor and idProduct in the USB device that owns a tty.
+// ttyACM devices point at the USB interface, ttyUSB devices one level below it.
+func usbID(device string) string {
+	dir, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return ""
+	}
+	for i := 0; i < USB_PARENT_DEPTH; i++ {
+		vid, err := ioutil.ReadFile(filepath.Join(dir, "idVendor"))
+		if err == nil {
+			pid, err := ioutil.ReadFile(filepath.Join(dir, "idProduct"))
+			if err != nil {
+				return ""
+			}
+			return strings.TrimSpace(string(vid)) + ":" + strings.TrimSpace(string(pid))
+		}
+		dir = filepath.Dir(dir)
+	}
+	return ""
+}
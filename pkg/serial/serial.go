@@ -1,6 +1,8 @@
 package serial
 
 import (
+	"errors"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,8 +18,47 @@ const (
 	START2          = 0xc3
 	PACKET_MTU      = 512
 	PORT_SPEED      = 921600
+
+	// Consecutive read errors before the port is considered dead
+	DEAD_PORT_ERRORS = 3
+	RECONNECT_MIN    = 250 * time.Millisecond
+	RECONNECT_MAX    = 30 * time.Second
+
+	// Console output longer than this without a newline is split
+	DEBUG_LINE_MAX = 1024
+)
+
+// WakeStrategy decides when START1 bytes are sent to wake the radio before a packet
+type WakeStrategy int
+
+const (
+	WAKE_ALWAYS     WakeStrategy = iota // before every packet
+	WAKE_AFTER_IDLE                     // only when nothing was sent for Options.WakeIdle
+	WAKE_NEVER
 )
 
+// Options are the serial line settings, DefaultOptions matches the firmware defaults
+type Options struct {
+	Baud        int
+	ReadTimeout time.Duration // 0 blocks until a byte arrives
+	Wake        WakeStrategy
+	WakeIdle    time.Duration // idle time before waking again with WAKE_AFTER_IDLE
+	WakeDelay   time.Duration // wait after the wake bytes for the radio to initalize, NO_WAKE_DELAY for none
+	PacketGap   time.Duration // minimum time from the end of one packet to the next, 0 sends back to back
+}
+
+// NO_WAKE_DELAY sends the packet right after the wake bytes, a zero WakeDelay takes the default
+const NO_WAKE_DELAY time.Duration = -1
+
+// DefaultOptions wakes the radio before every packet at PORT_SPEED
+func DefaultOptions() Options {
+	return Options{
+		Baud:      PORT_SPEED,
+		Wake:      WAKE_ALWAYS,
+		WakeDelay: WAIT_AFTER_WAKE,
+	}
+}
+
 // Buffer for serial reader
 type serialBuffer struct {
 	buf    []byte
@@ -31,88 +72,318 @@ type serialBuffer struct {
 type SerialPort struct {
 	Config   *serial.Config
 	port     mt.ReadWriteCloseFlusher
+	portMu   sync.Mutex // guards port and portDone, Close and reconnect both close the port
+	portDone bool       // port was closed
+	open     func(*serial.Config) (mt.ReadWriteCloseFlusher, error)
 	recvChan chan []byte
 	recvMu   *sync.Mutex
 	stopped  uint32
+	stats    mt.StatsInterface
+	logger   log.FieldLogger
+	onState  func(mt.ConnState)
+	onDebug  func(string)
+	// reconnect backoff, doubles after each failed attempt
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+	opts         Options
+	sendMu       sync.Mutex // serializes writes, guards lastSend
+	lastSend     time.Time
+}
+
+// Option configures a SerialPort
+type Option func(*SerialPort)
+
+// WithLogger sends logs to l instead of the logrus standard logger
+func WithLogger(l log.FieldLogger) Option {
+	return func(s *SerialPort) {
+		s.logger = l
+	}
+}
+
+// WithStateHandler calls fn when the port is lost, while reopening it and once it is back.
+// fn is called from the Listen goroutine.
+func WithStateHandler(fn func(mt.ConnState)) Option {
+	return func(s *SerialPort) {
+		s.onState = fn
+	}
+}
+
+// WithDebugHandler calls fn with each line of the firmware debug console,
+// which shares the UART with the framed packets. fn is called from the Listen goroutine.
+func WithDebugHandler(fn func(line string)) Option {
+	return func(s *SerialPort) {
+		s.onDebug = fn
+	}
+}
+
+// WithStats reports frame counters to st
+func WithStats(st mt.StatsInterface) Option {
+	return func(s *SerialPort) {
+		s.stats = st
+	}
+}
+
+// WithOptions sets the baud rate, read timeout, wake and pacing behavior.
+// A zero Baud or WakeDelay takes the DefaultOptions value, use NO_WAKE_DELAY to not wait after waking.
+func WithOptions(o Options) Option {
+	return func(s *SerialPort) {
+		def := DefaultOptions()
+		if o.Baud == 0 {
+			o.Baud = def.Baud
+		}
+		switch {
+		case o.WakeDelay == 0:
+			o.WakeDelay = def.WakeDelay
+		case o.WakeDelay < 0:
+			o.WakeDelay = 0
+		}
+		s.opts = o
+	}
 }
 
 // NewSerialPort configures and returns an instance of SerialPort.
 // device e.g. "/dev/ttyUSB0", recvCh is queue for received packets, mu is mutex for recvCh
-func NewSerialPort(dev string, recvCh chan []byte, mu *sync.Mutex) *SerialPort {
+func NewSerialPort(dev string, recvCh chan []byte, mu *sync.Mutex, opts ...Option) *SerialPort {
 	sp := &SerialPort{
-		Config:   &serial.Config{Name: dev, Baud: PORT_SPEED},
 		recvChan: recvCh,
 		recvMu:   mu,
+		stats:    mt.NopStats{},
+		logger:   log.StandardLogger(),
+		open:     openPort,
+
+		reconnectMin: RECONNECT_MIN,
+		reconnectMax: RECONNECT_MAX,
+		opts:         DefaultOptions(),
 	}
+	for _, opt := range opts {
+		opt(sp)
+	}
+	sp.Config = &serial.Config{Name: dev, Baud: sp.opts.Baud, ReadTimeout: sp.opts.ReadTimeout}
+	sp.logger = sp.logger.WithField(mt.FIELD_COMPONENT, "serial").WithField(mt.FIELD_DEVICE, dev)
 	return sp
 }
 
+func openPort(cfg *serial.Config) (mt.ReadWriteCloseFlusher, error) {
+	return serial.OpenPort(cfg)
+}
+
 // Connect to serial port
 func (s *SerialPort) Connect() error {
-	var err error
-	s.port, err = serial.OpenPort(s.Config)
+	port, err := s.open(s.Config)
 	if err != nil {
-		log.WithError(err).WithField("device", s.Config.Name).Error("could not open serial port")
+		s.logger.WithError(err).Error("could not open serial port")
 		return err
 	}
+	if !s.setPort(port) {
+		return errors.New("serial port was closed")
+	}
 	return nil
 }
 
+func (s *SerialPort) getPort() mt.ReadWriteCloseFlusher {
+	s.portMu.Lock()
+	defer s.portMu.Unlock()
+	return s.port
+}
+
+// setPort uses a newly opened port. If Close ran in the meantime the port is closed
+// and false returned, so it does not stay open.
+func (s *SerialPort) setPort(port mt.ReadWriteCloseFlusher) bool {
+	s.portMu.Lock()
+	defer s.portMu.Unlock()
+	if s.isStopped() {
+		port.Close()
+		return false
+	}
+	s.port = port
+	s.portDone = false
+	return true
+}
+
+// closePort closes the port unless that happened already, must hold portMu
+func (s *SerialPort) closePort() {
+	if s.port == nil || s.portDone {
+		return
+	}
+	s.port.Close()
+	s.portDone = true
+}
+
 // SendToRadio wake serial port and send packet to radio. Adds serial header.
 func (s *SerialPort) SendToRadio(data []byte) error {
-	// Wake serial port on radio
-	log.Debug("writing wake packet to port")
-	_, err := s.port.Write([]byte{START1, START1, START1, START1})
-	if err != nil {
-		log.WithError(err).Error("could not write to port")
-		return err
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	port := s.getPort()
+
+	if s.opts.PacketGap > 0 && !s.lastSend.IsZero() {
+		if wait := s.opts.PacketGap - time.Since(s.lastSend); wait > 0 {
+			time.Sleep(wait)
+		}
 	}
 
-	// Wait for radio to initalize
-	time.Sleep(WAIT_AFTER_WAKE)
+	if s.needsWake() {
+		// Wake serial port on radio
+		s.logger.Debug("writing wake packet to port")
+		_, err := port.Write([]byte{START1, START1, START1, START1})
+		if err != nil {
+			s.logger.WithError(err).Error("could not write to port")
+			return err
+		}
+
+		// Wait for radio to initalize
+		time.Sleep(s.opts.WakeDelay)
+	}
 
 	dlen := len(data)
 	header := []byte{START1, START2, byte(dlen >> 8), byte(dlen)}
 	data = append(header, data...)
 
-	log.WithField("packet_len", dlen).Debug("writing data packet to port")
-	_, err = s.port.Write(data)
+	s.logger.WithField(mt.FIELD_PACKET_LEN, dlen).Debug("writing data packet to port")
+	_, err := port.Write(data)
 	if err != nil {
-		log.WithError(err).Error("could not write to port")
+		s.logger.WithError(err).Error("could not write to port")
 		return err
 	}
-	s.port.Flush()
+	port.Flush()
+	s.lastSend = time.Now()
+	s.stats.FrameSent()
 	return nil
 }
 
+// needsWake must be called with sendMu held
+func (s *SerialPort) needsWake() bool {
+	switch s.opts.Wake {
+	case WAKE_NEVER:
+		return false
+	case WAKE_AFTER_IDLE:
+		return s.lastSend.IsZero() || time.Since(s.lastSend) >= s.opts.WakeIdle
+	default:
+		return true
+	}
+}
+
 // Close stop listening and close serial port
 func (s *SerialPort) Close() {
-	log.Debug("closing serial port")
-	atomic.SwapUint32(&s.stopped, 0)
+	s.logger.Debug("closing serial port")
+	s.portMu.Lock()
+	defer s.portMu.Unlock()
+	// Under portMu, a reconnect either sees stopped or stored its port for us to close
+	atomic.StoreUint32(&s.stopped, 1)
+	if s.port == nil || s.portDone {
+		return
+	}
 	s.port.Flush()
-	s.port.Close()
+	s.closePort()
+}
+
+func (s *SerialPort) isStopped() bool {
+	return atomic.LoadUint32(&s.stopped) != 0
+}
+
+func (s *SerialPort) setState(st mt.ConnState) {
+	s.logger.WithField(mt.FIELD_STATE, st).Info("serial port state changed")
+	if s.onState != nil {
+		s.onState(st)
+	}
+}
+
+// reconnect closes the dead port and reopens it with exponential backoff.
+// Returns false if the port was closed while waiting.
+func (s *SerialPort) reconnect() bool {
+	s.setState(mt.STATE_DISCONNECTED)
+	s.portMu.Lock()
+	s.closePort()
+	s.portMu.Unlock()
+
+	backoff := s.reconnectMin
+	for !s.isStopped() {
+		time.Sleep(backoff)
+		if s.isStopped() {
+			break
+		}
+		s.setState(mt.STATE_RECONNECTING)
+		port, err := s.open(s.Config)
+		if err == nil {
+			if !s.setPort(port) {
+				break
+			}
+			s.setState(mt.STATE_CONNECTED)
+			return true
+		}
+		s.logger.WithError(err).Debug("could not reopen serial port")
+		backoff *= 2
+		if backoff > s.reconnectMax {
+			backoff = s.reconnectMax
+		}
+	}
+	return false
+}
+
+// debugByte gathers bytes outside of frames into console lines, returns the line buffer to use next
+func (s *SerialPort) debugByte(line []byte, c byte) []byte {
+	if s.onDebug == nil {
+		return line
+	}
+	if c == '\n' || len(line) >= DEBUG_LINE_MAX {
+		if len(line) > 0 {
+			s.onDebug(string(line))
+		}
+		line = line[:0]
+		if c == '\n' {
+			return line
+		}
+	}
+	if c == '\r' {
+		return line
+	}
+	return append(line, c)
+}
+
+// idleRead is true for an EOF that took d to return. With a read timeout an idle
+// port reads as EOF once the timeout is up, an unplugged one right away.
+func (s *SerialPort) idleRead(d time.Duration) bool {
+	return s.Config != nil && s.Config.ReadTimeout > 0 && d >= s.Config.ReadTimeout/2
 }
 
 // Listen starts read stream buffering and parses packet header. Should be run in goroutine.
 // Return message as protobuff bytes that still need to be marshalled
 func (s *SerialPort) Listen() {
-	log.Debug("listening to serial port")
+	s.logger.Debug("listening to serial port")
 	sb := &serialBuffer{}
+	port := s.getPort()
+	readErrors := 0
+	line := make([]byte, 0, DEBUG_LINE_MAX)
 	// read stream
-	for s.stopped == 0 {
+	for !s.isStopped() {
 		b := make([]byte, 1)
-		n, err := s.port.Read(b)
-		if err != nil {
-			log.WithError(err).Debug("error reading bytes from port")
+		start := time.Now()
+		n, err := port.Read(b)
+		if err != nil && !s.isStopped() {
+			if err == io.EOF && s.idleRead(time.Since(start)) {
+				continue
+			}
+			s.logger.WithError(err).Debug("error reading bytes from port")
+			readErrors++
+			if readErrors >= DEAD_PORT_ERRORS {
+				if !s.reconnect() {
+					return
+				}
+				port = s.getPort()
+				sb = &serialBuffer{}
+				readErrors = 0
+			}
+			continue
 		}
 		if n == 0 {
 			continue
 		}
+		readErrors = 0
 
 		// track and buffer bytes until we have a complete message
 		switch sb.idx {
 		case 0:
 			if b[0] != START1 {
+				line = s.debugByte(line, b[0])
 				sb.idx = 0 // restart
 				continue
 			}
@@ -122,6 +393,9 @@ func (s *SerialPort) Listen() {
 				continue
 			}
 			if b[0] != START2 {
+				// START1 can be part of a UTF-8 sequence in console text
+				line = s.debugByte(line, START1)
+				line = s.debugByte(line, b[0])
 				sb.idx = 0 // restart
 				continue
 			}
@@ -132,18 +406,19 @@ func (s *SerialPort) Listen() {
 			sb.msgLen = sb.lenMsb + sb.lenLsb
 			// Check if packet is too big
 			if sb.msgLen > PACKET_MTU {
-				log.WithField("packet_len", sb.msgLen).Debug("packet will exceed maximum size, discarding")
+				s.logger.WithField(mt.FIELD_PACKET_LEN, sb.msgLen).Debug("packet will exceed maximum size, discarding")
+				s.stats.FrameDiscarded(sb.msgLen)
 				sb = &serialBuffer{}
 				continue
 			}
-			log.WithField("packet_len", sb.msgLen).Debug("packet header received, starting to buffer")
+			s.logger.WithField(mt.FIELD_PACKET_LEN, sb.msgLen).Debug("packet header received, starting to buffer")
 			sb.buf = make([]byte, sb.msgLen)
 		default:
 			pktSize := sb.idx - 4
 			// FIXME, this does not work, for now it seems we cant overflow
 			// Check if packet is too big
 			// if pktSize > sb.msgLen {
-			// 	log.Debug("packet was too big, discarding")
+			// 	s.logger.Debug("packet was too big, discarding")
 			// 	sb = &serialBuffer{}
 			// 	continue
 			// }
@@ -151,7 +426,8 @@ func (s *SerialPort) Listen() {
 			sb.buf[pktSize] = b[0]
 			// This should be the whole message
 			if sb.idx == sb.msgLen+4-1 {
-				log.Debug("completed packet buffering, adding to queue")
+				s.logger.WithField(mt.FIELD_PACKET_LEN, sb.msgLen).Debug("completed packet buffering, adding to queue")
+				s.stats.FrameReceived()
 				s.recvMu.Lock()
 				s.recvChan <- sb.buf
 				s.recvMu.Unlock()
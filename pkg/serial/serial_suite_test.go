@@ -2,29 +2,43 @@ package serial
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/tarm/serial"
 
 	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
 	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 func TestSerial(t *testing.T) {
-	log.SetLevel(log.DebugLevel)
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Serial Suite")
 }
 
+var logger = func() *log.Logger {
+	l := log.New()
+	l.SetLevel(log.DebugLevel)
+	return l
+}()
+
 var fakeData = []byte{0x1, 0x2, 0x3, 0x4}
 
 type mockPort struct {
-	buf []byte
+	buf    []byte
+	delay  time.Duration // before EOF once buf is empty, like a read timeout
+	closes int32
 }
 
 // Returns the buff slice one byte at a time
@@ -35,26 +49,36 @@ func (m *mockPort) Read(data []byte) (int, error) {
 		n = 1
 		m.buf = m.buf[1:]
 	} else {
-		return 0, os.ErrClosed
+		time.Sleep(m.delay)
+		return 0, io.EOF
 	}
 	return n, nil
 }
 
 // Satisfy ReadWriteCloseFlusher interface
 func (m *mockPort) Write([]byte) (int, error) { return 0, nil }
-func (m *mockPort) Close() error              { return nil }
+func (m *mockPort) Close() error              { atomic.AddInt32(&m.closes, 1); return nil }
 func (m *mockPort) Flush() error              { return nil }
 
 var _ = Describe("serial port lib tests", func() {
 	var portMock *mt.MockReadWriteCloseFlusher
+	var statsMock *mt.MockStatsInterface
 	var sp *SerialPort
 	BeforeEach(func() {
 		ctrl := gomock.NewController(GinkgoT())
 		portMock = mt.NewMockReadWriteCloseFlusher(ctrl)
+		statsMock = mt.NewMockStatsInterface(ctrl)
 		sp = &SerialPort{
 			port:     portMock,
 			recvChan: make(chan []byte, 1),
 			recvMu:   &sync.Mutex{},
+			stats:    statsMock,
+			logger:   logger,
+			open: func(*serial.Config) (mt.ReadWriteCloseFlusher, error) {
+				return nil, errors.New("no such device")
+			},
+			reconnectMin: time.Millisecond,
+			reconnectMax: 4 * time.Millisecond,
 		}
 	})
 	Context("test interface", func() {
@@ -63,6 +87,15 @@ var _ = Describe("serial port lib tests", func() {
 			Expect(sp).Should(BeAssignableToTypeOf(iface))
 		})
 	})
+	Context("NewSerialPort", func() {
+		It("should tag logs with the device", func() {
+			l, hook := test.NewNullLogger()
+			sp := NewSerialPort("/dev/nonexistent", make(chan []byte, 1), &sync.Mutex{}, WithLogger(l))
+			Expect(sp.Connect()).ShouldNot(Succeed())
+			Expect(hook.LastEntry().Data).Should(HaveKeyWithValue(mt.FIELD_COMPONENT, "serial"))
+			Expect(hook.LastEntry().Data).Should(HaveKeyWithValue(mt.FIELD_DEVICE, "/dev/nonexistent"))
+		})
+	})
 	Context("SendToRadio", func() {
 		It("should work", func() {
 			portMock.
@@ -73,6 +106,7 @@ var _ = Describe("serial port lib tests", func() {
 				Write(gomock.Len(len(fakeData)+4)).
 				Return(0, nil)
 			portMock.EXPECT().Flush().Return(nil)
+			statsMock.EXPECT().FrameSent()
 
 			err := sp.SendToRadio(fakeData)
 			Expect(err).Should(BeNil())
@@ -101,6 +135,65 @@ var _ = Describe("serial port lib tests", func() {
 			Expect(err).Should(HaveOccurred())
 		})
 	})
+	Context("Options", func() {
+		It("should default to today's behavior", func() {
+			sp := NewSerialPort("/dev/null", make(chan []byte, 1), &sync.Mutex{})
+			Expect(sp.Config.Baud).Should(Equal(PORT_SPEED))
+			Expect(sp.Config.ReadTimeout).Should(BeZero())
+			Expect(sp.opts.Wake).Should(Equal(WAKE_ALWAYS))
+			Expect(sp.opts.WakeDelay).Should(Equal(WAIT_AFTER_WAKE))
+		})
+		It("should configure the port", func() {
+			o := DefaultOptions()
+			o.Baud = 115200
+			o.ReadTimeout = time.Second
+			sp := NewSerialPort("/dev/null", make(chan []byte, 1), &sync.Mutex{}, WithOptions(o))
+			Expect(sp.Config.Baud).Should(Equal(115200))
+			Expect(sp.Config.ReadTimeout).Should(Equal(time.Second))
+		})
+		It("should fill in what partial options leave out", func() {
+			sp := NewSerialPort("/dev/null", make(chan []byte, 1), &sync.Mutex{}, WithOptions(Options{Wake: WAKE_NEVER}))
+			Expect(sp.Config.Baud).Should(Equal(PORT_SPEED))
+			Expect(sp.opts.Wake).Should(Equal(WAKE_NEVER))
+			Expect(sp.opts.WakeDelay).Should(Equal(WAIT_AFTER_WAKE))
+
+			sp = NewSerialPort("/dev/null", make(chan []byte, 1), &sync.Mutex{}, WithOptions(Options{WakeDelay: NO_WAKE_DELAY}))
+			Expect(sp.opts.WakeDelay).Should(BeZero())
+		})
+		It("should never wake", func() {
+			sp.opts = Options{Wake: WAKE_NEVER}
+			portMock.EXPECT().Write(gomock.Len(len(fakeData)+4)).Return(0, nil).Times(2)
+			portMock.EXPECT().Flush().Return(nil).Times(2)
+			statsMock.EXPECT().FrameSent().Times(2)
+			Expect(sp.SendToRadio(fakeData)).Should(Succeed())
+			Expect(sp.SendToRadio(fakeData)).Should(Succeed())
+		})
+		It("should wake only after idle", func() {
+			sp.opts = Options{Wake: WAKE_AFTER_IDLE, WakeIdle: 20 * time.Millisecond}
+			wake := portMock.EXPECT().Write(gomock.Eq([]byte{START1, START1, START1, START1})).Return(0, nil)
+			portMock.EXPECT().Write(gomock.Len(len(fakeData)+4)).Return(0, nil).Times(2).After(wake)
+			portMock.EXPECT().Flush().Return(nil).AnyTimes()
+			statsMock.EXPECT().FrameSent().AnyTimes()
+			Expect(sp.SendToRadio(fakeData)).Should(Succeed())
+			Expect(sp.SendToRadio(fakeData)).Should(Succeed())
+
+			time.Sleep(30 * time.Millisecond)
+			portMock.EXPECT().Write(gomock.Eq([]byte{START1, START1, START1, START1})).Return(0, nil)
+			portMock.EXPECT().Write(gomock.Len(len(fakeData)+4)).Return(0, nil)
+			Expect(sp.SendToRadio(fakeData)).Should(Succeed())
+		})
+		It("should pace packets", func() {
+			sp.opts = Options{Wake: WAKE_NEVER, PacketGap: 20 * time.Millisecond}
+			portMock.EXPECT().Write(gomock.Any()).Return(0, nil).Times(3)
+			portMock.EXPECT().Flush().Return(nil).Times(3)
+			statsMock.EXPECT().FrameSent().Times(3)
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				Expect(sp.SendToRadio(fakeData)).Should(Succeed())
+			}
+			Expect(time.Since(start)).Should(BeNumerically(">=", 40*time.Millisecond))
+		})
+	})
 	Context("reader", func() {
 		It("should work", func() {
 			data := []byte{
@@ -111,12 +204,175 @@ var _ = Describe("serial port lib tests", func() {
 			data = append(data, fakeData...)
 			data = append(data, 0x99) // extra byte to test overflow
 
-			msp := &mockPort{data}
+			statsMock.EXPECT().FrameDiscarded(gomock.Any())
+			statsMock.EXPECT().FrameReceived()
+
+			msp := &mockPort{buf: data}
 			sp.port = msp
 			go sp.Listen()
 
 			Expect(<-sp.recvChan).Should(Equal(fakeData))
 			sp.Close()
 		})
+		It("should split out firmware console lines", func() {
+			lines := make(chan string, 10)
+			sp.onDebug = func(l string) { lines <- l }
+			data := []byte("Booting\r\nlora init ")
+			data = append(data, START1, START2, 0, byte(len(fakeData)))
+			data = append(data, fakeData...)
+			data = append(data, []byte("done\n\n\xe2\x80\x94ok\n")...) // em dash contains START1
+
+			statsMock.EXPECT().FrameReceived()
+			sp.port = &mockPort{buf: data}
+			go sp.Listen()
+
+			Expect(<-sp.recvChan).Should(Equal(fakeData))
+			Eventually(lines).Should(Receive(Equal("Booting")))
+			Eventually(lines).Should(Receive(Equal("lora init done")))
+			Eventually(lines).Should(Receive(Equal("\u2014ok")))
+			sp.Close()
+		})
+	})
+	Context("Candidates", func() {
+		var root string
+		// usbDev creates a USB device in the fake sysfs tree with a tty below iface
+		usbDev := func(name, vid, pid, iface, tty string) {
+			dev := filepath.Join(root, "sys/devices/pci0000:00/usb1", name)
+			Expect(os.MkdirAll(filepath.Join(dev, iface), 0755)).Should(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dev, "idVendor"), []byte(vid+"\n"), 0644)).Should(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dev, "idProduct"), []byte(pid+"\n"), 0644)).Should(Succeed())
+			class := filepath.Join(root, SYSFS_TTY, tty)
+			Expect(os.MkdirAll(class, 0755)).Should(Succeed())
+			Expect(os.Symlink(filepath.Join(dev, iface), filepath.Join(class, "device"))).Should(Succeed())
+		}
+		BeforeEach(func() {
+			var err error
+			root, err = ioutil.TempDir("", "sysfs")
+			Expect(err).Should(BeNil())
+			usbDev("1-1", "10c4", "ea60", "1-1:1.0/ttyUSB0", "ttyUSB0")
+			usbDev("1-2", "303a", "0002", "1-2:1.0", "ttyACM0")
+			usbDev("1-3", "046d", "c52b", "1-3:1.0", "ttyACM1") // not a radio
+			Expect(os.MkdirAll(filepath.Join(root, SYSFS_TTY, "ttyS0"), 0755)).Should(Succeed())
+
+			byID := filepath.Join(root, DEV_BY_ID)
+			Expect(os.MkdirAll(byID, 0755)).Should(Succeed())
+			link := filepath.Join(byID, "usb-Silicon_Labs_CP2102_USB_to_UART_Bridge_Controller_0001-if00-port0")
+			Expect(os.Symlink("../../ttyUSB0", link)).Should(Succeed())
+		})
+		AfterEach(func() {
+			os.RemoveAll(root)
+		})
+		It("should find known USB bridges", func() {
+			c, err := Candidates(root)
+			Expect(err).Should(BeNil())
+			Expect(c).Should(Equal([]Candidate{
+				{
+					Path:   filepath.Join(root, DEV, "ttyACM0"),
+					Tty:    "ttyACM0",
+					UsbId:  "303a:0002",
+					Bridge: "ESP32-S2",
+				},
+				{
+					Path:   filepath.Join(root, DEV_BY_ID, "usb-Silicon_Labs_CP2102_USB_to_UART_Bridge_Controller_0001-if00-port0"),
+					Tty:    "ttyUSB0",
+					UsbId:  "10c4:ea60",
+					Bridge: "CP210x",
+				},
+			}))
+		})
+		It("should error without sysfs", func() {
+			_, err := Candidates(filepath.Join(root, "nothing"))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Context("reconnect", func() {
+		It("should reopen a dead port", func() {
+			frame := append([]byte{START1, START2, 0, byte(len(fakeData))}, fakeData...)
+			opens := 0
+			sp.open = func(*serial.Config) (mt.ReadWriteCloseFlusher, error) {
+				opens++
+				switch {
+				case opens < 3:
+					return nil, errors.New("no such device")
+				case opens == 3:
+					return &mockPort{buf: frame}, nil
+				}
+				return &mockPort{}, nil
+			}
+			states := make(chan mt.ConnState, 100)
+			sp.onState = func(st mt.ConnState) {
+				states <- st
+			}
+			sp.port = &mockPort{}
+			statsMock.EXPECT().FrameReceived()
+
+			go sp.Listen()
+			Eventually(sp.recvChan).Should(Receive(Equal(fakeData)))
+			sp.Close()
+
+			for _, exp := range []mt.ConnState{
+				mt.STATE_DISCONNECTED,
+				mt.STATE_RECONNECTING,
+				mt.STATE_RECONNECTING,
+				mt.STATE_RECONNECTING,
+				mt.STATE_CONNECTED,
+			} {
+				Expect(<-states).Should(Equal(exp))
+			}
+		})
+		It("should stop reconnecting when closed", func() {
+			sp.port = &mockPort{}
+			done := make(chan bool)
+			go func() {
+				sp.Listen()
+				close(done)
+			}()
+			time.Sleep(10 * time.Millisecond)
+			sp.Close()
+			Eventually(done).Should(BeClosed())
+		})
+		It("should not leak a port opened while closing", func() {
+			old, reopened := &mockPort{}, &mockPort{}
+			opening, closed := make(chan bool), make(chan bool)
+			sp.open = func(*serial.Config) (mt.ReadWriteCloseFlusher, error) {
+				opening <- true
+				<-closed
+				return reopened, nil
+			}
+			sp.port = old
+			done := make(chan bool)
+			go func() {
+				sp.Listen()
+				close(done)
+			}()
+			<-opening
+			sp.Close()
+			close(closed)
+			Eventually(done).Should(BeClosed())
+			Expect(atomic.LoadInt32(&old.closes)).Should(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&reopened.closes)).Should(BeEquivalentTo(1))
+		})
+		It("should treat EOF as idle with a read timeout", func() {
+			sp.Config = &serial.Config{ReadTimeout: 5 * time.Millisecond}
+			states := make(chan mt.ConnState, 100)
+			sp.onState = func(st mt.ConnState) {
+				states <- st
+			}
+			sp.port = &mockPort{delay: 5 * time.Millisecond}
+			go sp.Listen()
+			Consistently(states, 50*time.Millisecond).ShouldNot(Receive())
+			sp.Close()
+		})
+		It("should find a dead port with a read timeout", func() {
+			sp.Config = &serial.Config{ReadTimeout: time.Second}
+			states := make(chan mt.ConnState, 100)
+			sp.onState = func(st mt.ConnState) {
+				states <- st
+			}
+			sp.port = &mockPort{}
+			go sp.Listen()
+			Eventually(states).Should(Receive(Equal(mt.STATE_DISCONNECTED)))
+			sp.Close()
+		})
 	})
 })
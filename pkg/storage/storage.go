@@ -0,0 +1,396 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	mt "github.com/nerdoftech/Meshtastic-go/pkg/types"
+)
+
+const (
+	BUCKET_META      = "meta"
+	BUCKET_PACKETS   = "packets"
+	BUCKET_NODES     = "nodes"
+	BUCKET_POSITIONS = "positions"
+	BUCKET_SNR       = "snr"
+
+	KEY_SCHEMA_VERSION = "schema_version"
+
+	OPEN_TIMEOUT = 1 * time.Second
+)
+
+// ErrSchemaTooNew is returned when the database was written by a newer version of this package
+var ErrSchemaTooNew = errors.New("database schema is newer than this library supports")
+
+// migrations are applied in order, the schema version is the number of applied migrations.
+// Never edit or reorder an existing migration, append a new one instead.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: buckets for each record kind, records are keyed by node then time
+	func(tx *bolt.Tx) error {
+		for _, b := range []string{BUCKET_PACKETS, BUCKET_NODES, BUCKET_POSITIONS, BUCKET_SNR} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// Store records mesh traffic in an embedded bbolt database
+type Store struct {
+	db     *bolt.DB
+	logger log.FieldLogger
+}
+
+// Option configures a Store
+type Option func(*Store)
+
+// WithLogger sends logs to l instead of the logrus standard logger
+func WithLogger(l log.FieldLogger) Option {
+	return func(s *Store) {
+		s.logger = l
+	}
+}
+
+// Query filters stored records, zero values match everything
+type Query struct {
+	Node    uint32
+	Channel string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Packet is a MeshPacket as it was received
+type Packet struct {
+	Time    time.Time
+	Channel string
+	Packet  *message.MeshPacket
+}
+
+// NodeSnapshot is a NodeInfo as it was received
+type NodeSnapshot struct {
+	Time    time.Time
+	Channel string
+	Node    *message.NodeInfo
+}
+
+// Position is a position report from a node
+type Position struct {
+	Time     time.Time
+	Channel  string
+	Node     uint32
+	Position *message.Position
+}
+
+// SNR is a signal to noise sample for a node
+type SNR struct {
+	Time    time.Time
+	Channel string
+	Node    uint32
+	Snr     float32
+}
+
+// record is the on disk format for all buckets
+type record struct {
+	Time    int64   `json:"time"`
+	Channel string  `json:"channel,omitempty"`
+	Node    uint32  `json:"node"`
+	Data    []byte  `json:"data,omitempty"`
+	Snr     float32 `json:"snr,omitempty"`
+}
+
+// Open opens or creates the database at path and applies any pending migrations
+func Open(path string, opts ...Option) (*Store, error) {
+	s := &Store{logger: log.StandardLogger()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.logger = s.logger.WithField(mt.FIELD_COMPONENT, "storage").WithField(mt.FIELD_PATH, path)
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if err != nil {
+		s.logger.WithError(err).Error("could not open database")
+		return nil, err
+	}
+	s.db = db
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Version returns the schema version of the database
+func (s *Store) Version() (int, error) {
+	var v int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v = schemaVersion(tx)
+		return nil
+	})
+	return v, err
+}
+
+func (s *Store) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(BUCKET_META))
+		if err != nil {
+			return err
+		}
+		v := schemaVersion(tx)
+		if v > len(migrations) {
+			s.logger.WithField(mt.FIELD_SCHEMA_VERSION, v).Error("database schema is too new")
+			return ErrSchemaTooNew
+		}
+		for ; v < len(migrations); v++ {
+			s.logger.WithField(mt.FIELD_SCHEMA_VERSION, v+1).Debug("applying database migration")
+			if err = migrations[v](tx); err != nil {
+				s.logger.WithError(err).WithField(mt.FIELD_SCHEMA_VERSION, v+1).Error("database migration failed")
+				return err
+			}
+		}
+		return meta.Put([]byte(KEY_SCHEMA_VERSION), uint32Key(uint32(v)))
+	})
+}
+
+func schemaVersion(tx *bolt.Tx) int {
+	meta := tx.Bucket([]byte(BUCKET_META))
+	if meta == nil {
+		return 0
+	}
+	v := meta.Get([]byte(KEY_SCHEMA_VERSION))
+	if len(v) != 4 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(v))
+}
+
+// Record subscribes to the mesh and saves everything it receives.
+// Records are tagged with the channel name the radio is configured for.
+func (s *Store) Record(m *mesh.Mesh) {
+	channel := func() string {
+		return m.GetRadioConfig().GetChannelSettings().GetName()
+	}
+	m.Subscribe(mesh.TOPIC_DATA, func(p interface{}) {
+		err := s.SavePacket(time.Now(), channel(), p.(*message.MeshPacket))
+		if err != nil {
+			s.logger.WithError(err).Error("could not save packet")
+		}
+	})
+	m.Subscribe(mesh.TOPIC_NODE, func(n interface{}) {
+		err := s.SaveNodeInfo(time.Now(), channel(), n.(*message.NodeInfo))
+		if err != nil {
+			s.logger.WithError(err).Error("could not save node info")
+		}
+	})
+}
+
+// SavePacket stores a packet along with any position and SNR it carries
+func (s *Store) SavePacket(t time.Time, channel string, pkt *message.MeshPacket) error {
+	data, err := proto.Marshal(pkt)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := put(tx, BUCKET_PACKETS, &record{Time: t.UnixNano(), Channel: channel, Node: pkt.From, Data: data})
+		if err != nil {
+			return err
+		}
+		if pos := pkt.GetDecoded().GetPosition(); pos != nil {
+			err = putPosition(tx, t, channel, pkt.From, pos)
+			if err != nil {
+				return err
+			}
+		}
+		// 0 dB is a sample too, at the noise floor
+		return put(tx, BUCKET_SNR, &record{Time: t.UnixNano(), Channel: channel, Node: pkt.From, Snr: pkt.RxSnr})
+	})
+}
+
+// SaveNodeInfo stores a node snapshot along with its position and SNR
+func (s *Store) SaveNodeInfo(t time.Time, channel string, node *message.NodeInfo) error {
+	data, err := proto.Marshal(node)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := put(tx, BUCKET_NODES, &record{Time: t.UnixNano(), Channel: channel, Node: node.Num, Data: data})
+		if err != nil {
+			return err
+		}
+		if node.Position != nil {
+			err = putPosition(tx, t, channel, node.Num, node.Position)
+			if err != nil {
+				return err
+			}
+		}
+		return put(tx, BUCKET_SNR, &record{Time: t.UnixNano(), Channel: channel, Node: node.Num, Snr: node.Snr})
+	})
+}
+
+// Packets returns stored packets matching q, oldest first
+func (s *Store) Packets(q Query) ([]Packet, error) {
+	recs, err := s.find(BUCKET_PACKETS, q)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Packet, 0, len(recs))
+	for _, r := range recs {
+		pkt := &message.MeshPacket{}
+		if err = proto.Unmarshal(r.Data, pkt); err != nil {
+			return nil, err
+		}
+		res = append(res, Packet{Time: time.Unix(0, r.Time), Channel: r.Channel, Packet: pkt})
+	}
+	return res, nil
+}
+
+// Nodes returns stored node snapshots matching q, oldest first
+func (s *Store) Nodes(q Query) ([]NodeSnapshot, error) {
+	recs, err := s.find(BUCKET_NODES, q)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]NodeSnapshot, 0, len(recs))
+	for _, r := range recs {
+		node := &message.NodeInfo{}
+		if err = proto.Unmarshal(r.Data, node); err != nil {
+			return nil, err
+		}
+		res = append(res, NodeSnapshot{Time: time.Unix(0, r.Time), Channel: r.Channel, Node: node})
+	}
+	return res, nil
+}
+
+// Positions returns stored positions matching q, oldest first
+func (s *Store) Positions(q Query) ([]Position, error) {
+	recs, err := s.find(BUCKET_POSITIONS, q)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Position, 0, len(recs))
+	for _, r := range recs {
+		pos := &message.Position{}
+		if err = proto.Unmarshal(r.Data, pos); err != nil {
+			return nil, err
+		}
+		res = append(res, Position{Time: time.Unix(0, r.Time), Channel: r.Channel, Node: r.Node, Position: pos})
+	}
+	return res, nil
+}
+
+// SNR returns stored SNR history matching q, oldest first
+func (s *Store) SNR(q Query) ([]SNR, error) {
+	recs, err := s.find(BUCKET_SNR, q)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]SNR, 0, len(recs))
+	for _, r := range recs {
+		res = append(res, SNR{Time: time.Unix(0, r.Time), Channel: r.Channel, Node: r.Node, Snr: r.Snr})
+	}
+	return res, nil
+}
+
+func putPosition(tx *bolt.Tx, t time.Time, channel string, node uint32, pos *message.Position) error {
+	data, err := proto.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return put(tx, BUCKET_POSITIONS, &record{Time: t.UnixNano(), Channel: channel, Node: node, Data: data})
+}
+
+// put stores rec in a per node sub bucket, keyed by time then sequence
+func put(tx *bolt.Tx, bucket string, rec *record) error {
+	nb, err := tx.Bucket([]byte(bucket)).CreateBucketIfNotExists(uint32Key(rec.Node))
+	if err != nil {
+		return err
+	}
+	seq, err := nb.NextSequence()
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	key := append(timeKey(rec.Time), uint32Key(uint32(seq))...)
+	return nb.Put(key, val)
+}
+
+func (s *Store) find(bucket string, q Query) ([]*record, error) {
+	res := make([]*record, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if q.Node != 0 {
+			nb := b.Bucket(uint32Key(q.Node))
+			if nb == nil {
+				return nil
+			}
+			return scan(nb, q, &res)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			// only sub buckets live at the top level
+			return scan(b.Bucket(k), q, &res)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time < res[j].Time })
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	return res, nil
+}
+
+func scan(nb *bolt.Bucket, q Query, res *[]*record) error {
+	c := nb.Cursor()
+	var k, v []byte
+	if q.Since.IsZero() {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek(timeKey(q.Since.UnixNano()))
+	}
+	for ; k != nil; k, v = c.Next() {
+		if !q.Until.IsZero() && int64(binary.BigEndian.Uint64(k)) > q.Until.UnixNano() {
+			break
+		}
+		rec := &record{}
+		if err := json.Unmarshal(v, rec); err != nil {
+			return err
+		}
+		if q.Channel != "" && rec.Channel != q.Channel {
+			continue
+		}
+		*res = append(*res, rec)
+	}
+	return nil
+}
+
+func timeKey(t int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t))
+	return k
+}
+
+func uint32Key(n uint32) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, n)
+	return k
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestStorage(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Storage Suite")
+}
+
+var logger = func() *log.Logger {
+	l := log.New()
+	l.SetLevel(log.DebugLevel)
+	return l
+}()
+
+var _ = Describe("storage", func() {
+	var dir string
+	var store *Store
+	var t0 time.Time
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "storage")
+		Expect(err).Should(BeNil())
+		store, err = Open(filepath.Join(dir, "mesh.db"), WithLogger(logger))
+		Expect(err).Should(BeNil())
+		t0 = time.Unix(1594000000, 0)
+	})
+	AfterEach(func() {
+		store.Close()
+		os.RemoveAll(dir)
+	})
+	Context("migrations", func() {
+		It("should be at the latest version", func() {
+			v, err := store.Version()
+			Expect(err).Should(BeNil())
+			Expect(v).Should(Equal(len(migrations)))
+		})
+		It("should reopen without migrating again", func() {
+			store.Close()
+			var err error
+			store, err = Open(filepath.Join(dir, "mesh.db"), WithLogger(logger))
+			Expect(err).Should(BeNil())
+			v, _ := store.Version()
+			Expect(v).Should(Equal(len(migrations)))
+		})
+		It("should refuse a newer schema", func() {
+			err := store.db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte(BUCKET_META)).Put([]byte(KEY_SCHEMA_VERSION), uint32Key(99))
+			})
+			Expect(err).Should(BeNil())
+			store.Close()
+			_, err = Open(filepath.Join(dir, "mesh.db"), WithLogger(logger))
+			Expect(err).Should(Equal(ErrSchemaTooNew))
+			store, _ = Open(filepath.Join(dir, "other.db"), WithLogger(logger))
+		})
+	})
+	Context("packets", func() {
+		BeforeEach(func() {
+			for i := 0; i < 3; i++ {
+				pkt := &message.MeshPacket{
+					From:  uint32(1 + i%2),
+					Id:    uint32(i),
+					RxSnr: 5.5,
+					Payload: &message.MeshPacket_Decoded{
+						Decoded: &message.SubPacket{
+							Payload: &message.SubPacket_Position{
+								Position: &message.Position{LatitudeI: int32(i)},
+							},
+						},
+					},
+				}
+				ch := "lora1"
+				if i == 2 {
+					ch = "lora2"
+				}
+				err := store.SavePacket(t0.Add(time.Duration(i)*time.Minute), ch, pkt)
+				Expect(err).Should(BeNil())
+			}
+		})
+		It("should return everything in time order", func() {
+			res, err := store.Packets(Query{})
+			Expect(err).Should(BeNil())
+			Expect(res).Should(HaveLen(3))
+			for i, p := range res {
+				Expect(p.Packet.Id).Should(Equal(uint32(i)))
+			}
+		})
+		It("should filter by node", func() {
+			res, err := store.Packets(Query{Node: 2})
+			Expect(err).Should(BeNil())
+			Expect(res).Should(HaveLen(1))
+			Expect(res[0].Packet.Id).Should(Equal(uint32(1)))
+		})
+		It("should filter by time range", func() {
+			res, err := store.Packets(Query{Since: t0.Add(time.Minute), Until: t0.Add(time.Minute)})
+			Expect(err).Should(BeNil())
+			Expect(res).Should(HaveLen(1))
+			Expect(res[0].Time.Equal(t0.Add(time.Minute))).Should(BeTrue())
+		})
+		It("should filter by channel and limit", func() {
+			res, err := store.Packets(Query{Channel: "lora1", Limit: 1})
+			Expect(err).Should(BeNil())
+			Expect(res).Should(HaveLen(1))
+			Expect(res[0].Channel).Should(Equal("lora1"))
+		})
+		It("should record positions and snr", func() {
+			pos, err := store.Positions(Query{Node: 1})
+			Expect(err).Should(BeNil())
+			Expect(pos).Should(HaveLen(2))
+			Expect(pos[1].Position.LatitudeI).Should(Equal(int32(2)))
+
+			snr, err := store.SNR(Query{})
+			Expect(err).Should(BeNil())
+			Expect(snr).Should(HaveLen(3))
+			Expect(snr[0].Snr).Should(Equal(float32(5.5)))
+		})
+		It("should record 0 dB samples", func() {
+			Expect(store.SavePacket(t0.Add(time.Hour), "lora1", &message.MeshPacket{From: 3})).Should(Succeed())
+			Expect(store.SaveNodeInfo(t0.Add(time.Hour), "lora1", &message.NodeInfo{Num: 3})).Should(Succeed())
+			snr, err := store.SNR(Query{Node: 3})
+			Expect(err).Should(BeNil())
+			Expect(snr).Should(HaveLen(2))
+			Expect(snr[0].Snr).Should(BeZero())
+			Expect(snr[1].Snr).Should(BeZero())
+		})
+	})
+	Context("nodes", func() {
+		It("should save snapshots", func() {
+			node := &message.NodeInfo{
+				Num:      7,
+				Snr:      -3,
+				Position: &message.Position{LongitudeI: 10},
+				User:     &message.User{LongName: "bob"},
+			}
+			Expect(store.SaveNodeInfo(t0, "lora1", node)).Should(Succeed())
+
+			res, err := store.Nodes(Query{Node: 7})
+			Expect(err).Should(BeNil())
+			Expect(res).Should(HaveLen(1))
+			Expect(res[0].Node.User.LongName).Should(Equal("bob"))
+
+			pos, _ := store.Positions(Query{Node: 7})
+			Expect(pos).Should(HaveLen(1))
+			snr, _ := store.SNR(Query{Node: 7})
+			Expect(snr).Should(HaveLen(1))
+
+			res, err = store.Nodes(Query{Node: 8})
+			Expect(err).Should(BeNil())
+			Expect(res).Should(BeEmpty())
+		})
+	})
+})
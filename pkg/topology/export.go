@@ -0,0 +1,87 @@
+package topology
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type graphJSON struct {
+	Nodes []nodeJSON `json:"nodes"`
+	Edges []edgeJSON `json:"edges"`
+}
+
+type nodeJSON struct {
+	ID   string `json:"id"`
+	Num  uint32 `json:"num"`
+	Name string `json:"name"`
+	Self bool   `json:"self,omitempty"`
+}
+
+type edgeJSON struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Snr     *float32 `json:"snr,omitempty"`
+	Source  Source   `json:"source"`
+	AgeSecs float64  `json:"age_secs"`
+}
+
+// nodeID is the node number as the apps show it, used to name vertices in exports
+func nodeID(num uint32) string {
+	return fmt.Sprintf("!%08x", num)
+}
+
+// WriteJSON writes the graph as {"nodes": [...], "edges": [...]}, edges reference nodes by id
+func (g *Graph) WriteJSON(w io.Writer) error {
+	nodes, edges := g.Nodes(), g.Edges()
+	now := g.now()
+	doc := graphJSON{Nodes: make([]nodeJSON, 0, len(nodes)), Edges: make([]edgeJSON, 0, len(edges))}
+	for _, n := range nodes {
+		doc.Nodes = append(doc.Nodes, nodeJSON{ID: nodeID(n.Num), Num: n.Num, Name: n.DisplayName(), Self: n.Self})
+	}
+	for _, e := range edges {
+		ej := edgeJSON{From: nodeID(e.From), To: nodeID(e.To), Source: e.Source, AgeSecs: e.Age(now).Seconds()}
+		if e.HasSnr {
+			snr := e.Snr
+			ej.Snr = &snr
+		}
+		doc.Edges = append(doc.Edges, ej)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// WriteDOT writes the graph for Graphviz, edges are labelled with their SNR when known
+// and dashed when learned from a route rather than from the node list
+func (g *Graph) WriteDOT(w io.Writer) error {
+	nodes, edges := g.Nodes(), g.Edges()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph mesh {")
+	for _, n := range nodes {
+		attrs := "label=" + strconv.Quote(n.DisplayName())
+		if n.Self {
+			attrs += ", shape=doublecircle"
+		}
+		fmt.Fprintf(bw, "  %q [%s];\n", nodeID(n.Num), attrs)
+	}
+	for _, e := range edges {
+		attrs := []string{}
+		if e.HasSnr {
+			attrs = append(attrs, fmt.Sprintf("label=\"%.1f dB\"", e.Snr))
+		}
+		if e.Source == SOURCE_ROUTE {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(bw, "  %q -> %q", nodeID(e.From), nodeID(e.To))
+		if len(attrs) > 0 {
+			fmt.Fprintf(bw, " [%s]", strings.Join(attrs, ", "))
+		}
+		fmt.Fprintln(bw, ";")
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
@@ -0,0 +1,256 @@
+package topology
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+)
+
+// Source tells where an edge was learned
+type Source string
+
+const (
+	SOURCE_NODE  Source = "node"  // NodeInfo.NextHop and Snr
+	SOURCE_ROUTE Source = "route" // a RouteDiscovery result
+)
+
+// Edge is a link packets travel over, To has heard From
+type Edge struct {
+	From, To uint32
+	// SNR in dB measured by To, only known for links to our own node
+	Snr    float32
+	HasSnr bool
+	Source Source
+	Seen   time.Time
+}
+
+// Age is how long ago the edge was last confirmed
+func (e Edge) Age(now time.Time) time.Duration {
+	return now.Sub(e.Seen)
+}
+
+// Node is a vertex of the graph
+type Node struct {
+	Num  uint32
+	Name string
+	Self bool // the radio we are connected to
+}
+
+// DisplayName returns the node name, or the node number as the apps show it
+func (n Node) DisplayName() string {
+	if n.Name != "" {
+		return n.Name
+	}
+	return fmt.Sprintf("!%08x", n.Num)
+}
+
+type edgeKey struct {
+	from, to uint32
+}
+
+// Graph is a directed graph of the mesh built from NodeInfo and RouteDiscovery results
+type Graph struct {
+	mu    *sync.Mutex
+	self  uint32
+	nodes map[uint32]*Node
+	edges map[edgeKey]*Edge
+	now   func() time.Time
+}
+
+// NewGraph returns an empty Graph
+func NewGraph() *Graph {
+	return &Graph{
+		mu:    &sync.Mutex{},
+		nodes: make(map[uint32]*Node),
+		edges: make(map[edgeKey]*Edge),
+		now:   time.Now,
+	}
+}
+
+// Record subscribes to the NodeInfo and routes the mesh receives
+func (g *Graph) Record(m *mesh.Mesh) {
+	m.Subscribe(mesh.TOPIC_NODE, func(n interface{}) {
+		g.SetSelf(m.GetMyNodeInfo().GetMyNodeNum())
+		g.AddNodeInfo(n.(*message.NodeInfo))
+	})
+	m.Subscribe(mesh.TOPIC_ROUTE, func(r interface{}) {
+		g.AddRoute(r.(*mesh.Route).Hops)
+	})
+}
+
+// SetSelf sets the node number of our own radio, 0 is ignored
+func (g *Graph) SetSelf(num uint32) {
+	if num == 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if old, ok := g.nodes[g.self]; ok {
+		old.Self = false
+	}
+	g.self = num
+	g.node(num).Self = true
+}
+
+// AddNodeInfo adds the links a NodeInfo implies. A node that is its own next hop is
+// a neighbor and its Snr is the quality of the link to us, 0 dB included, otherwise
+// the path goes through the next hop.
+func (g *Graph) AddNodeInfo(ni *message.NodeInfo) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := g.node(ni.GetNum())
+	if name := ni.GetUser().GetLongName(); name != "" {
+		n.Name = name
+	}
+	if g.self == 0 || ni.GetNum() == g.self {
+		return
+	}
+	switch hop := ni.GetNextHop(); hop {
+	case 0:
+	case ni.GetNum():
+		g.addEdge(g.self, hop, SOURCE_NODE, 0, false)
+		g.addEdge(hop, g.self, SOURCE_NODE, ni.GetSnr(), true)
+	default:
+		g.addEdge(g.self, hop, SOURCE_NODE, 0, false)
+		g.addEdge(hop, ni.GetNum(), SOURCE_NODE, 0, false)
+	}
+}
+
+// AddRoute adds an edge for each step of a route, as returned by Mesh.DiscoverRoute
+func (g *Graph) AddRoute(hops []uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i := 0; i+1 < len(hops); i++ {
+		g.addEdge(hops[i], hops[i+1], SOURCE_ROUTE, 0, false)
+	}
+}
+
+// must hold mu
+func (g *Graph) node(num uint32) *Node {
+	n, ok := g.nodes[num]
+	if !ok {
+		n = &Node{Num: num}
+		g.nodes[num] = n
+	}
+	return n
+}
+
+// must hold mu. A known SNR is kept when the edge is confirmed without one.
+func (g *Graph) addEdge(from, to uint32, src Source, snr float32, hasSnr bool) {
+	if from == to {
+		return
+	}
+	g.node(from)
+	g.node(to)
+	k := edgeKey{from, to}
+	e, ok := g.edges[k]
+	if !ok {
+		e = &Edge{From: from, To: to}
+		g.edges[k] = e
+	}
+	e.Source = src
+	e.Seen = g.now()
+	if hasSnr {
+		e.Snr, e.HasSnr = snr, true
+	}
+}
+
+// Prune drops edges older than maxAge and the nodes left without edges, except our own
+func (g *Graph) Prune(maxAge time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	used := map[uint32]bool{g.self: true}
+	for k, e := range g.edges {
+		if e.Age(now) > maxAge {
+			delete(g.edges, k)
+			continue
+		}
+		used[e.From], used[e.To] = true, true
+	}
+	for num := range g.nodes {
+		if !used[num] {
+			delete(g.nodes, num)
+		}
+	}
+}
+
+// Nodes returns a copy of the nodes ordered by node number
+func (g *Graph) Nodes() []Node {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	res := make([]Node, 0, len(g.nodes))
+	for _, n := range g.nodes {
+		res = append(res, *n)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Num < res[j].Num })
+	return res
+}
+
+// Edges returns a copy of the edges ordered by From then To
+func (g *Graph) Edges() []Edge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.edgeList()
+}
+
+// must hold mu
+func (g *Graph) edgeList() []Edge {
+	res := make([]Edge, 0, len(g.edges))
+	for _, e := range g.edges {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].From != res[j].From {
+			return res[i].From < res[j].From
+		}
+		return res[i].To < res[j].To
+	})
+	return res
+}
+
+// Reachable returns the nodes within hops edges of from, ordered by node number, from itself excluded
+func (g *Graph) Reachable(from uint32, hops int) []uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make(map[uint32][]uint32)
+	for k := range g.edges {
+		out[k.from] = append(out[k.from], k.to)
+	}
+	seen := map[uint32]bool{from: true}
+	frontier := []uint32{from}
+	res := []uint32{}
+	for i := 0; i < hops && len(frontier) > 0; i++ {
+		next := []uint32{}
+		for _, n := range frontier {
+			for _, to := range out[n] {
+				if !seen[to] {
+					seen[to] = true
+					next = append(next, to)
+					res = append(res, to)
+				}
+			}
+		}
+		frontier = next
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// WeakestLink returns the edge with the lowest SNR, false if no edge has one
+func (g *Graph) WeakestLink() (Edge, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var weakest Edge
+	found := false
+	for _, e := range g.edgeList() {
+		if e.HasSnr && (!found || e.Snr < weakest.Snr) {
+			weakest, found = e, true
+		}
+	}
+	return weakest, found
+}
@@ -0,0 +1,105 @@
+package topology
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTopology(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Topology Suite")
+}
+
+var _ = Describe("topology", func() {
+	t0 := time.Unix(1594000000, 0)
+	var g *Graph
+	var now time.Time
+	BeforeEach(func() {
+		now = t0
+		g = NewGraph()
+		g.now = func() time.Time { return now }
+		g.SetSelf(1)
+		// 2 and 3 are neighbors, 4 is reached through 3
+		g.AddNodeInfo(&message.NodeInfo{Num: 1, User: &message.User{LongName: "base"}})
+		g.AddNodeInfo(&message.NodeInfo{Num: 2, NextHop: 2, Snr: 7.5})
+		g.AddNodeInfo(&message.NodeInfo{Num: 3, NextHop: 3, Snr: -4})
+		g.AddNodeInfo(&message.NodeInfo{Num: 4, NextHop: 3})
+		g.AddNodeInfo(&message.NodeInfo{Num: 6})
+	})
+	Context("graph", func() {
+		It("should add links from NodeInfo", func() {
+			Expect(g.Nodes()).Should(HaveLen(5))
+			Expect(g.Nodes()[0]).Should(Equal(Node{Num: 1, Name: "base", Self: true}))
+			edges := g.Edges()
+			Expect(edges).Should(HaveLen(5))
+			Expect(edges[0]).Should(Equal(Edge{From: 1, To: 2, Source: SOURCE_NODE, Seen: t0}))
+			Expect(edges[2]).Should(Equal(Edge{From: 2, To: 1, Snr: 7.5, HasSnr: true, Source: SOURCE_NODE, Seen: t0}))
+			Expect(edges[4]).Should(Equal(Edge{From: 3, To: 4, Source: SOURCE_NODE, Seen: t0}))
+		})
+		It("should add routes and update the SNR of neighbors", func() {
+			now = t0.Add(time.Minute)
+			g.AddRoute([]uint32{1, 3, 4, 5})
+			// 0 dB is a valid SNR for a neighbor
+			g.AddNodeInfo(&message.NodeInfo{Num: 3, NextHop: 3})
+			edges := g.Edges()
+			Expect(edges).Should(HaveLen(6))
+			Expect(edges[3].From).Should(Equal(uint32(3)))
+			Expect(edges[3].Snr).Should(BeZero())
+			Expect(edges[3].HasSnr).Should(BeTrue())
+			Expect(edges[3].Age(now)).Should(Equal(time.Duration(0)))
+			Expect(edges[5]).Should(Equal(Edge{From: 4, To: 5, Source: SOURCE_ROUTE, Seen: now}))
+		})
+		It("should find nodes within N hops", func() {
+			Expect(g.Reachable(1, 1)).Should(Equal([]uint32{2, 3}))
+			Expect(g.Reachable(1, 2)).Should(Equal([]uint32{2, 3, 4}))
+			Expect(g.Reachable(4, 3)).Should(BeEmpty())
+		})
+		It("should find the weakest link", func() {
+			e, ok := g.WeakestLink()
+			Expect(ok).Should(BeTrue())
+			Expect(e.From).Should(Equal(uint32(3)))
+			Expect(e.Snr).Should(Equal(float32(-4)))
+			_, ok = NewGraph().WeakestLink()
+			Expect(ok).Should(BeFalse())
+		})
+		It("should prune old edges", func() {
+			now = t0.Add(time.Hour)
+			g.AddRoute([]uint32{1, 2})
+			g.Prune(time.Minute)
+			Expect(g.Edges()).Should(HaveLen(1))
+			Expect(g.Nodes()).Should(HaveLen(2))
+		})
+	})
+	Context("export", func() {
+		It("should write DOT", func() {
+			g.AddRoute([]uint32{3, 4})
+			buf := &bytes.Buffer{}
+			Expect(g.WriteDOT(buf)).Should(Succeed())
+			Expect(buf.String()).Should(HavePrefix("digraph mesh {\n"))
+			Expect(buf.String()).Should(ContainSubstring("  \"!00000001\" [label=\"base\", shape=doublecircle];\n"))
+			Expect(buf.String()).Should(ContainSubstring("  \"!00000002\" -> \"!00000001\" [label=\"7.5 dB\"];\n"))
+			Expect(buf.String()).Should(ContainSubstring("  \"!00000003\" -> \"!00000004\" [style=dashed];\n"))
+			Expect(buf.String()).Should(ContainSubstring("  \"!00000001\" -> \"!00000002\";\n"))
+			Expect(buf.String()).Should(HaveSuffix("}\n"))
+		})
+		It("should write JSON", func() {
+			now = t0.Add(30 * time.Second)
+			buf := &bytes.Buffer{}
+			Expect(g.WriteJSON(buf)).Should(Succeed())
+			doc := graphJSON{}
+			Expect(json.Unmarshal(buf.Bytes(), &doc)).Should(Succeed())
+			Expect(doc.Nodes).Should(HaveLen(5))
+			Expect(doc.Nodes[1]).Should(Equal(nodeJSON{ID: "!00000002", Num: 2, Name: "!00000002"}))
+			Expect(doc.Edges[0].Snr).Should(BeNil())
+			Expect(*doc.Edges[2].Snr).Should(Equal(float32(7.5)))
+			Expect(doc.Edges[2].AgeSecs).Should(Equal(30.0))
+		})
+	})
+})
@@ -0,0 +1,192 @@
+package track
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	GPX_NAMESPACE = "http://www.topografix.com/GPX/1/1"
+	KML_NAMESPACE = "http://www.opengis.net/kml/2.2"
+	CREATOR       = "Meshtastic-go"
+)
+
+type gpx struct {
+	XMLName xml.Name   `xml:"gpx"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Segment gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Ele  int32   `xml:"ele"`
+	Time string  `xml:"time,omitempty"`
+}
+
+// WriteGPX writes tracks as a GPX 1.1 document, one trk per node
+func WriteGPX(w io.Writer, tracks []Track) error {
+	doc := gpx{Xmlns: GPX_NAMESPACE, Version: "1.1", Creator: CREATOR}
+	for _, t := range tracks {
+		gt := gpxTrack{Name: t.DisplayName()}
+		for _, p := range t.Points {
+			gt.Segment.Points = append(gt.Segment.Points, gpxPoint{
+				Lat:  p.Lat,
+				Lon:  p.Lon,
+				Ele:  p.Alt,
+				Time: timestamp(p.Time),
+			})
+		}
+		doc.Tracks = append(doc.Tracks, gt)
+	}
+	return writeXML(w, doc)
+}
+
+type kml struct {
+	XMLName  xml.Name    `xml:"kml"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name       string         `xml:"name"`
+	TimeSpan   *kmlTimeSpan   `xml:"TimeSpan,omitempty"`
+	LineString *kmlLineString `xml:"LineString,omitempty"`
+	Point      *kmlPoint      `xml:"Point,omitempty"`
+}
+
+type kmlTimeSpan struct {
+	Begin string `xml:"begin,omitempty"`
+	End   string `xml:"end,omitempty"`
+}
+
+type kmlLineString struct {
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+type kmlPoint struct {
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+// WriteKML writes tracks as a KML document, one Placemark per node.
+// Single point tracks are written as a Point, otherwise a LineString.
+func WriteKML(w io.Writer, tracks []Track) error {
+	doc := kml{Xmlns: KML_NAMESPACE, Document: kmlDocument{Name: CREATOR}}
+	for _, t := range tracks {
+		if len(t.Points) == 0 {
+			continue
+		}
+		pm := kmlPlacemark{Name: t.DisplayName()}
+		first, last := t.Points[0], t.Points[len(t.Points)-1]
+		if !first.Time.IsZero() {
+			pm.TimeSpan = &kmlTimeSpan{Begin: timestamp(first.Time), End: timestamp(last.Time)}
+		}
+		coords := make([]string, 0, len(t.Points))
+		for _, p := range t.Points {
+			coords = append(coords, fmt.Sprintf("%.7f,%.7f,%d", p.Lon, p.Lat, p.Alt))
+		}
+		if len(coords) == 1 {
+			pm.Point = &kmlPoint{AltitudeMode: "absolute", Coordinates: coords[0]}
+		} else {
+			pm.LineString = &kmlLineString{AltitudeMode: "absolute", Coordinates: strings.Join(coords, " ")}
+		}
+		doc.Document.Placemarks = append(doc.Document.Placemarks, pm)
+	}
+	return writeXML(w, doc)
+}
+
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+type feature struct {
+	Type       string                 `json:"type"`
+	Geometry   geometry               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// WriteGeoJSON writes tracks as a GeoJSON FeatureCollection, one Feature per node.
+// Per point times and battery levels are kept in the feature properties.
+func WriteGeoJSON(w io.Writer, tracks []Track) error {
+	fc := featureCollection{Type: "FeatureCollection", Features: make([]feature, 0, len(tracks))}
+	for _, t := range tracks {
+		if len(t.Points) == 0 {
+			continue
+		}
+		coords := make([][]float64, 0, len(t.Points))
+		times := make([]string, 0, len(t.Points))
+		battery := make([]int32, 0, len(t.Points))
+		for _, p := range t.Points {
+			coords = append(coords, []float64{p.Lon, p.Lat, float64(p.Alt)})
+			times = append(times, timestamp(p.Time))
+			battery = append(battery, p.Battery)
+		}
+		geo := geometry{Type: "LineString", Coordinates: coords}
+		if len(coords) == 1 {
+			geo = geometry{Type: "Point", Coordinates: coords[0]}
+		}
+		fc.Features = append(fc.Features, feature{
+			Type:     "Feature",
+			Geometry: geo,
+			Properties: map[string]interface{}{
+				"node":    t.Node,
+				"name":    t.DisplayName(),
+				"times":   times,
+				"battery": battery,
+			},
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(fc)
+}
+
+func writeXML(w io.Writer, doc interface{}) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,154 @@
+package track
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/mesh"
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+)
+
+// Point is a Position converted to float degrees
+type Point struct {
+	Lat     float64
+	Lon     float64
+	Alt     int32 // meters
+	Battery int32 // 1-100, 0 means not provided
+	Time    time.Time
+}
+
+// Track is the ordered list of points for a node
+type Track struct {
+	Node   uint32
+	Name   string
+	Points []Point
+}
+
+// Latitude returns the latitude of p in degrees
+func Latitude(p *message.Position) float64 {
+	return float64(p.GetLatitudeI()) / mesh.DEGREES_SCALE
+}
+
+// Longitude returns the longitude of p in degrees
+func Longitude(p *message.Position) float64 {
+	return float64(p.GetLongitudeI()) / mesh.DEGREES_SCALE
+}
+
+// HasFix is false when the position carries no coordinates
+func HasFix(p *message.Position) bool {
+	return p.GetLatitudeI() != 0 || p.GetLongitudeI() != 0
+}
+
+// FromPosition converts p to a Point. If the radio did not include a time, rx is used.
+func FromPosition(p *message.Position, rx time.Time) Point {
+	pt := Point{
+		Lat:     Latitude(p),
+		Lon:     Longitude(p),
+		Alt:     p.GetAltitude(),
+		Battery: p.GetBatteryLevel(),
+		Time:    rx,
+	}
+	if p.GetTime() != 0 {
+		pt.Time = time.Unix(int64(p.GetTime()), 0)
+	}
+	return pt
+}
+
+// Recorder keeps a track for every node it hears a position from
+type Recorder struct {
+	mu     *sync.Mutex
+	tracks map[uint32]*Track
+}
+
+// NewRecorder returns an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{
+		mu:     &sync.Mutex{},
+		tracks: make(map[uint32]*Track),
+	}
+}
+
+// Record subscribes to positions in NodeInfo and SubPacket_Position from the mesh
+func (r *Recorder) Record(m *mesh.Mesh) {
+	m.Subscribe(mesh.TOPIC_NODE, func(n interface{}) {
+		node := n.(*message.NodeInfo)
+		r.SetName(node.Num, node.GetUser().GetLongName())
+		if node.Position != nil {
+			r.Add(node.Num, node.Position, time.Now())
+		}
+	})
+	m.Subscribe(mesh.TOPIC_DATA, func(p interface{}) {
+		pkt := p.(*message.MeshPacket)
+		if pos := pkt.GetDecoded().GetPosition(); pos != nil {
+			r.Add(pkt.From, pos, time.Now())
+		}
+	})
+}
+
+// SetName sets the display name used for a node's track, empty names are ignored
+func (r *Recorder) SetName(node uint32, name string) {
+	if name == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.track(node).Name = name
+}
+
+// Add a position for node. Positions without a fix are dropped, as are repeats of
+// the last point: the radio resends NodeInfo with an unchanged position, and Record
+// sees a position both in the packet and in the NodeInfo it updates.
+func (r *Recorder) Add(node uint32, p *message.Position, rx time.Time) {
+	if !HasFix(p) {
+		return
+	}
+	pt := FromPosition(p, rx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.track(node)
+	if n := len(t.Points); n > 0 {
+		last := t.Points[n-1]
+		if last.Lat == pt.Lat && last.Lon == pt.Lon && last.Alt == pt.Alt && (p.GetTime() == 0 || last.Time.Equal(pt.Time)) {
+			return
+		}
+	}
+	t.Points = append(t.Points, pt)
+	sort.SliceStable(t.Points, func(i, j int) bool { return t.Points[i].Time.Before(t.Points[j].Time) })
+}
+
+// Tracks returns a copy of all tracks ordered by node number
+func (r *Recorder) Tracks() []Track {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]Track, 0, len(r.tracks))
+	for _, t := range r.tracks {
+		if len(t.Points) == 0 {
+			continue
+		}
+		cp := *t
+		cp.Points = append([]Point(nil), t.Points...)
+		res = append(res, cp)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Node < res[j].Node })
+	return res
+}
+
+// must hold mu
+func (r *Recorder) track(node uint32) *Track {
+	t, ok := r.tracks[node]
+	if !ok {
+		t = &Track{Node: node}
+		r.tracks[node] = t
+	}
+	return t
+}
+
+// DisplayName returns the track name, or the node number as the apps show it
+func (t *Track) DisplayName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("!%08x", t.Node)
+}
@@ -0,0 +1,104 @@
+package track
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTrack(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Track Suite")
+}
+
+var _ = Describe("track", func() {
+	t0 := time.Unix(1594000000, 0)
+	pos := func(lat, lon int32, tm uint32) *message.Position {
+		return &message.Position{LatitudeI: lat, LongitudeI: lon, Altitude: 100, BatteryLevel: 80, Time: tm}
+	}
+	var rec *Recorder
+	BeforeEach(func() {
+		rec = NewRecorder()
+		rec.SetName(1, "alpha")
+		rec.Add(1, pos(374219999, -1220840575, 1594000060), t0)
+		rec.Add(1, pos(374200000, -1220800000, 1594000000), t0)
+		rec.Add(2, pos(10, 20, 0), t0)
+	})
+	Context("conversion", func() {
+		It("should convert to degrees", func() {
+			p := pos(374219999, -1220840575, 0)
+			Expect(Latitude(p)).Should(BeNumerically("~", 37.4219999, 1e-9))
+			Expect(Longitude(p)).Should(BeNumerically("~", -122.0840575, 1e-9))
+			pt := FromPosition(p, t0)
+			Expect(pt.Time).Should(Equal(t0))
+			Expect(pt.Battery).Should(Equal(int32(80)))
+			pt = FromPosition(pos(1, 1, 1594000060), t0)
+			Expect(pt.Time.Unix()).Should(Equal(int64(1594000060)))
+		})
+	})
+	Context("recorder", func() {
+		It("should keep tracks per node in time order", func() {
+			tr := rec.Tracks()
+			Expect(tr).Should(HaveLen(2))
+			Expect(tr[0].Name).Should(Equal("alpha"))
+			Expect(tr[0].Points).Should(HaveLen(2))
+			Expect(tr[0].Points[0].Time.Unix()).Should(Equal(int64(1594000000)))
+			Expect(tr[1].DisplayName()).Should(Equal("!00000002"))
+		})
+		It("should drop positions without a fix and repeats", func() {
+			rec.Add(3, pos(0, 0, 0), t0)
+			rec.Add(2, pos(10, 20, 0), t0.Add(time.Minute))
+			tr := rec.Tracks()
+			Expect(tr).Should(HaveLen(2))
+			Expect(tr[1].Points).Should(HaveLen(1))
+		})
+		It("should drop a timed position heard as a packet and in NodeInfo", func() {
+			rec.Add(1, pos(374300000, -1220900000, 1594000120), t0)
+			rec.Add(1, pos(374300000, -1220900000, 1594000120), t0.Add(time.Second))
+			// The same place at a later time is a new point
+			rec.Add(1, pos(374300000, -1220900000, 1594000180), t0.Add(time.Minute))
+			Expect(rec.Tracks()[0].Points).Should(HaveLen(4))
+		})
+	})
+	Context("export", func() {
+		It("should write GPX", func() {
+			buf := &bytes.Buffer{}
+			Expect(WriteGPX(buf, rec.Tracks())).Should(Succeed())
+			doc := gpx{}
+			Expect(xml.Unmarshal(buf.Bytes(), &doc)).Should(Succeed())
+			Expect(doc.Tracks).Should(HaveLen(2))
+			Expect(doc.Tracks[0].Segment.Points[1].Lat).Should(BeNumerically("~", 37.4219999, 1e-9))
+			Expect(doc.Tracks[0].Segment.Points[0].Time).Should(Equal("2020-07-06T01:46:40Z"))
+		})
+		It("should write KML", func() {
+			buf := &bytes.Buffer{}
+			Expect(WriteKML(buf, rec.Tracks())).Should(Succeed())
+			doc := kml{}
+			Expect(xml.Unmarshal(buf.Bytes(), &doc)).Should(Succeed())
+			Expect(doc.Document.Placemarks).Should(HaveLen(2))
+			Expect(doc.Document.Placemarks[0].LineString.Coordinates).Should(
+				Equal("-122.0800000,37.4200000,100 -122.0840575,37.4219999,100"))
+			Expect(doc.Document.Placemarks[1].Point).ShouldNot(BeNil())
+		})
+		It("should write GeoJSON", func() {
+			buf := &bytes.Buffer{}
+			Expect(WriteGeoJSON(buf, rec.Tracks())).Should(Succeed())
+			fc := map[string]interface{}{}
+			Expect(json.Unmarshal(buf.Bytes(), &fc)).Should(Succeed())
+			Expect(fc["type"]).Should(Equal("FeatureCollection"))
+			features := fc["features"].([]interface{})
+			Expect(features).Should(HaveLen(2))
+			geo := features[0].(map[string]interface{})["geometry"].(map[string]interface{})
+			Expect(geo["type"]).Should(Equal("LineString"))
+			geo = features[1].(map[string]interface{})["geometry"].(map[string]interface{})
+			Expect(geo["type"]).Should(Equal("Point"))
+		})
+	})
+})
@@ -4,6 +4,8 @@ package types
 
 import (
 	"io"
+	"sync"
+	"time"
 
 	"github.com/nerdoftech/Meshtastic-go/pkg/message"
 )
@@ -25,8 +27,28 @@ type TransportInterface interface {
 	Close()
 }
 
+// TransportFactory creates a transport that queues received messages on rxCh, holding mu while sending
+type TransportFactory func(rxCh chan []byte, mu *sync.Mutex) TransportInterface
+
 // ReadCloseWriteFlusher adds Flush() to ReadWriteCloser
 type ReadWriteCloseFlusher interface {
 	io.ReadWriteCloser
 	Flush() error
 }
+
+// StatsInterface receives counters from transports and the mesh, e.g. for pkg/metrics
+type StatsInterface interface {
+	FrameReceived()
+	FrameSent()
+	// Frame header announced more than PACKET_MTU bytes
+	FrameDiscarded(size int)
+	UnmarshalFailed()
+	UnsupportedVariant(variant string)
+	PacketReceived(pkt *message.MeshPacket)
+	NodeUpdated(node *message.NodeInfo)
+	AckReceived(node uint32, latency time.Duration)
+	// Radio reported a new critical fault, code is the mesh.FirmwareErrorCode name
+	FirmwareError(node uint32, code string)
+	// Packet from node was received again and dropped, see mesh.DEDUP_WINDOW
+	DuplicateDropped(node uint32)
+}
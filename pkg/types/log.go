@@ -0,0 +1,22 @@
+package types
+
+// Log field names shared by all packages, so library logs can be filtered and routed consistently
+const (
+	FIELD_COMPONENT      = "component"
+	FIELD_DEVICE         = "device"
+	FIELD_PATH           = "path"
+	FIELD_PACKET         = "packet"
+	FIELD_PACKET_ID      = "packet_id"
+	FIELD_PACKET_LEN     = "packet_len"
+	FIELD_CONFIG_ID      = "config_id"
+	FIELD_NODE           = "node"
+	FIELD_MY_NODE        = "my_node"
+	FIELD_RADIO          = "radio"
+	FIELD_POSITION       = "position"
+	FIELD_VARIANT        = "variant"
+	FIELD_TOPIC          = "topic"
+	FIELD_LATENCY        = "latency"
+	FIELD_STATE          = "state"
+	FIELD_SCHEMA_VERSION = "schema_version"
+	FIELD_MESSAGE_ID     = "message_id"
+)
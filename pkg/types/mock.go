@@ -8,6 +8,7 @@ import (
 	gomock "github.com/golang/mock/gomock"
 	message "github.com/nerdoftech/Meshtastic-go/pkg/message"
 	reflect "reflect"
+	time "time"
 )
 
 // MockMeshInterface is a mock of MeshInterface interface.
@@ -61,6 +62,20 @@ func (mr *MockMeshInterfaceMockRecorder) GetRadioConfig() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRadioConfig", reflect.TypeOf((*MockMeshInterface)(nil).GetRadioConfig))
 }
 
+// SetRadioConfig mocks base method.
+func (m *MockMeshInterface) SetRadioConfig(arg0 *message.RadioConfig) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetRadioConfig", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetRadioConfig indicates an expected call of SetRadioConfig.
+func (mr *MockMeshInterfaceMockRecorder) SetRadioConfig(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRadioConfig", reflect.TypeOf((*MockMeshInterface)(nil).SetRadioConfig), arg0)
+}
+
 // Close mocks base method.
 func (m *MockMeshInterface) Close() {
 	m.ctrl.T.Helper()
@@ -228,3 +243,146 @@ func (mr *MockReadWriteCloseFlusherMockRecorder) Flush() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Flush", reflect.TypeOf((*MockReadWriteCloseFlusher)(nil).Flush))
 }
+
+// MockStatsInterface is a mock of StatsInterface interface.
+type MockStatsInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockStatsInterfaceMockRecorder
+}
+
+// MockStatsInterfaceMockRecorder is the mock recorder for MockStatsInterface.
+type MockStatsInterfaceMockRecorder struct {
+	mock *MockStatsInterface
+}
+
+// NewMockStatsInterface creates a new mock instance.
+func NewMockStatsInterface(ctrl *gomock.Controller) *MockStatsInterface {
+	mock := &MockStatsInterface{ctrl: ctrl}
+	mock.recorder = &MockStatsInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockStatsInterface) EXPECT() *MockStatsInterfaceMockRecorder {
+	return m.recorder
+}
+
+// FrameReceived mocks base method.
+func (m *MockStatsInterface) FrameReceived() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "FrameReceived")
+}
+
+// FrameReceived indicates an expected call of FrameReceived.
+func (mr *MockStatsInterfaceMockRecorder) FrameReceived() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FrameReceived", reflect.TypeOf((*MockStatsInterface)(nil).FrameReceived))
+}
+
+// FrameSent mocks base method.
+func (m *MockStatsInterface) FrameSent() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "FrameSent")
+}
+
+// FrameSent indicates an expected call of FrameSent.
+func (mr *MockStatsInterfaceMockRecorder) FrameSent() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FrameSent", reflect.TypeOf((*MockStatsInterface)(nil).FrameSent))
+}
+
+// FrameDiscarded mocks base method.
+func (m *MockStatsInterface) FrameDiscarded(size int) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "FrameDiscarded", size)
+}
+
+// FrameDiscarded indicates an expected call of FrameDiscarded.
+func (mr *MockStatsInterfaceMockRecorder) FrameDiscarded(size interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FrameDiscarded", reflect.TypeOf((*MockStatsInterface)(nil).FrameDiscarded), size)
+}
+
+// UnmarshalFailed mocks base method.
+func (m *MockStatsInterface) UnmarshalFailed() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "UnmarshalFailed")
+}
+
+// UnmarshalFailed indicates an expected call of UnmarshalFailed.
+func (mr *MockStatsInterfaceMockRecorder) UnmarshalFailed() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnmarshalFailed", reflect.TypeOf((*MockStatsInterface)(nil).UnmarshalFailed))
+}
+
+// UnsupportedVariant mocks base method.
+func (m *MockStatsInterface) UnsupportedVariant(variant string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "UnsupportedVariant", variant)
+}
+
+// UnsupportedVariant indicates an expected call of UnsupportedVariant.
+func (mr *MockStatsInterfaceMockRecorder) UnsupportedVariant(variant interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnsupportedVariant", reflect.TypeOf((*MockStatsInterface)(nil).UnsupportedVariant), variant)
+}
+
+// PacketReceived mocks base method.
+func (m *MockStatsInterface) PacketReceived(pkt *message.MeshPacket) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "PacketReceived", pkt)
+}
+
+// PacketReceived indicates an expected call of PacketReceived.
+func (mr *MockStatsInterfaceMockRecorder) PacketReceived(pkt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PacketReceived", reflect.TypeOf((*MockStatsInterface)(nil).PacketReceived), pkt)
+}
+
+// NodeUpdated mocks base method.
+func (m *MockStatsInterface) NodeUpdated(node *message.NodeInfo) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "NodeUpdated", node)
+}
+
+// NodeUpdated indicates an expected call of NodeUpdated.
+func (mr *MockStatsInterfaceMockRecorder) NodeUpdated(node interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NodeUpdated", reflect.TypeOf((*MockStatsInterface)(nil).NodeUpdated), node)
+}
+
+// AckReceived mocks base method.
+func (m *MockStatsInterface) AckReceived(node uint32, latency time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "AckReceived", node, latency)
+}
+
+// AckReceived indicates an expected call of AckReceived.
+func (mr *MockStatsInterfaceMockRecorder) AckReceived(node, latency interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AckReceived", reflect.TypeOf((*MockStatsInterface)(nil).AckReceived), node, latency)
+}
+
+// FirmwareError mocks base method.
+func (m *MockStatsInterface) FirmwareError(node uint32, code string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "FirmwareError", node, code)
+}
+
+// FirmwareError indicates an expected call of FirmwareError.
+func (mr *MockStatsInterfaceMockRecorder) FirmwareError(node, code interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FirmwareError", reflect.TypeOf((*MockStatsInterface)(nil).FirmwareError), node, code)
+}
+
+// DuplicateDropped mocks base method.
+func (m *MockStatsInterface) DuplicateDropped(node uint32) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "DuplicateDropped", node)
+}
+
+// DuplicateDropped indicates an expected call of DuplicateDropped.
+func (mr *MockStatsInterfaceMockRecorder) DuplicateDropped(node interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DuplicateDropped", reflect.TypeOf((*MockStatsInterface)(nil).DuplicateDropped), node)
+}
@@ -0,0 +1,22 @@
+package types
+
+// ConnState is the state of the connection to the radio
+type ConnState int
+
+const (
+	STATE_DISCONNECTED ConnState = iota
+	STATE_RECONNECTING
+	STATE_CONNECTED
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case STATE_DISCONNECTED:
+		return "disconnected"
+	case STATE_RECONNECTING:
+		return "reconnecting"
+	case STATE_CONNECTED:
+		return "connected"
+	}
+	return "unknown"
+}
@@ -0,0 +1,21 @@
+package types
+
+import (
+	"time"
+
+	"github.com/nerdoftech/Meshtastic-go/pkg/message"
+)
+
+// NopStats is the default StatsInterface, it discards everything
+type NopStats struct{}
+
+func (NopStats) FrameReceived()                                 {}
+func (NopStats) FrameSent()                                     {}
+func (NopStats) FrameDiscarded(size int)                        {}
+func (NopStats) UnmarshalFailed()                               {}
+func (NopStats) UnsupportedVariant(variant string)              {}
+func (NopStats) PacketReceived(pkt *message.MeshPacket)         {}
+func (NopStats) NodeUpdated(node *message.NodeInfo)             {}
+func (NopStats) AckReceived(node uint32, latency time.Duration) {}
+func (NopStats) FirmwareError(node uint32, code string)         {}
+func (NopStats) DuplicateDropped(node uint32)                   {}